@@ -0,0 +1,12 @@
+package attrs
+
+import (
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Duration records an elapsed time; span handlers record it in integer nanoseconds.
+func Duration(key string, d time.Duration) slog.Attr {
+	return slog.Duration(key, d)
+}
@@ -0,0 +1,26 @@
+package attrs
+
+import (
+	"fmt"
+
+	"golang.org/x/exp/slog"
+)
+
+// Keys of the error attributes, so a key mapping (see StableHTTPKeys) can name them.
+const (
+	// ErrorKey is the key of Error, and of the errors kslog records itself (kslog.ErrorKey).
+	ErrorKey = "error"
+	// ErrorTypeKey is the key of ErrorType.
+	ErrorTypeKey = "error.type"
+)
+
+// Error records err under ErrorKey.
+// The value is the error itself, not its message, so span handlers can also record it as an exception.
+func Error(err error) slog.Attr {
+	return slog.Any(ErrorKey, err)
+}
+
+// ErrorType records the concrete type of err, e.g. *main.DialError.
+func ErrorType(err error) slog.Attr {
+	return slog.String(ErrorTypeKey, fmt.Sprintf("%T", err))
+}
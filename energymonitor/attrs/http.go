@@ -9,3 +9,12 @@ func HTTPMethod(method string) slog.Attr {
 func HTTPURL(url string) slog.Attr {
 	return slog.String("http.url", url)
 }
+
+func HTTPStatusCode(code int) slog.Attr {
+	return slog.Int("http.status_code", code)
+}
+
+// HTTPResponseSize is the size of the response body, in bytes.
+func HTTPResponseSize(n int64) slog.Attr {
+	return slog.Int64("http.response_size", n)
+}
@@ -0,0 +1,33 @@
+package attrs
+
+import (
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// KV returns an attribute with the slog constructor matching the type of value,
+// e.g. slog.Float64 for a float64, so callers needn't pick one.
+// Other types, such as errors or named types (even with a string underlying type), are recorded with slog.Any.
+func KV[T any](key string, value T) slog.Attr {
+	switch v := any(value).(type) {
+	case string:
+		return slog.String(key, v)
+	case int:
+		return slog.Int(key, v)
+	case int64:
+		return slog.Int64(key, v)
+	case uint64:
+		return slog.Uint64(key, v)
+	case float64:
+		return slog.Float64(key, v)
+	case bool:
+		return slog.Bool(key, v)
+	case time.Duration:
+		return slog.Duration(key, v)
+	case time.Time:
+		return slog.Time(key, v)
+	default:
+		return slog.Any(key, v)
+	}
+}
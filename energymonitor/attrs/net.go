@@ -0,0 +1,11 @@
+package attrs
+
+import "golang.org/x/exp/slog"
+
+func NetPeerName(host string) slog.Attr {
+	return slog.String("net.peer.name", host)
+}
+
+func NetPeerPort(port int) slog.Attr {
+	return slog.Int("net.peer.port", port)
+}
@@ -0,0 +1,19 @@
+package attrs
+
+import "golang.org/x/exp/slog"
+
+func RPCSystem(system string) slog.Attr {
+	return slog.String("rpc.system", system)
+}
+
+func RPCService(service string) slog.Attr {
+	return slog.String("rpc.service", service)
+}
+
+func RPCMethod(method string) slog.Attr {
+	return slog.String("rpc.method", method)
+}
+
+func RPCGRPCStatusCode(code int) slog.Attr {
+	return slog.Int("rpc.grpc.status_code", code)
+}
@@ -0,0 +1,13 @@
+package attrs
+
+// StableHTTPKeys maps the keys emitted by the HTTP and network helpers, which
+// follow the older semantic conventions, to their stable (v1.20+) names.
+// Pass it to kslog.SetKeyMapping to emit the stable names without changing call sites.
+var StableHTTPKeys = map[string]string{
+	"http.method":        "http.request.method",
+	"http.url":           "url.full",
+	"http.status_code":   "http.response.status_code",
+	"http.response_size": "http.response.body.size",
+	"net.peer.name":      "server.address",
+	"net.peer.port":      "server.port",
+}
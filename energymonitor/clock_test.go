@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose tickers only tick when the test says so.
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+var _ Clock = &fakeClock{}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTicker{c: make(chan time.Time), periods: []time.Duration{d}}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d and delivers a tick to the ticker, blocking
+// until the code under test receives it.
+func (c *fakeClock) Advance(t *fakeTicker, d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mutex.Unlock()
+	t.c <- now
+}
+
+// waitForTicker waits for the code under test to create a ticker, and returns the first.
+func (c *fakeClock) waitForTicker() *fakeTicker {
+	for {
+		c.mutex.Lock()
+		if len(c.tickers) != 0 {
+			t := c.tickers[0]
+			c.mutex.Unlock()
+			return t
+		}
+		c.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// ticker returns the only ticker created so far.
+func (c *fakeClock) ticker(t *testing.T) *fakeTicker {
+	t.Helper()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.tickers) != 1 {
+		t.Fatalf("got %d tickers, want 1", len(c.tickers))
+	}
+	return c.tickers[0]
+}
+
+type fakeTicker struct {
+	c chan time.Time
+
+	mutex sync.Mutex
+	// periods are the ticker's periods, from creation and then each Reset.
+	periods []time.Duration
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.periods = append(t.periods, d)
+}
+
+func (t *fakeTicker) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+}
+
+func (t *fakeTicker) state() ([]time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]time.Duration(nil), t.periods...), t.stopped
+}
+
+func TestReadMeterForever(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	reader := newTestGateway(t, func(r *http.Request) {
+		requests <- struct{}{}
+	})
+
+	clock := &fakeClock{now: time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- readMeterForever(ctx, clock, reader)
+	}()
+
+	ticker := clock.waitForTicker()
+
+	// The first read is soon after starting, then every minute.
+	clock.Advance(ticker, time.Second)
+	<-requests
+	clock.Advance(ticker, time.Minute)
+	<-requests
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("readMeterForever returned %v, want %v", err, context.Canceled)
+	}
+
+	periods, stopped := clock.ticker(t).state()
+	if len(periods) != 3 || periods[0] != time.Second || periods[1] != time.Minute || periods[2] != time.Minute {
+		t.Errorf("ticker periods were %v, want [1s 1m0s 1m0s]", periods)
+	}
+	if !stopped {
+		t.Errorf("ticker was not stopped")
+	}
+	if len(requests) != 0 {
+		t.Errorf("got %d more requests than ticks", len(requests))
+	}
+}
+
+// TestReadMeterForeverCancelDuringTick cancels ctx while a tick's read is in flight.
+func TestReadMeterForeverCancelDuringTick(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inFlight := make(chan struct{})
+	reader := newTestGateway(t, func(r *http.Request) {
+		close(inFlight)
+		// Hold the request until the client gives up.
+		<-r.Context().Done()
+	})
+
+	clock := &fakeClock{}
+	done := make(chan error)
+	go func() {
+		done <- readMeterForever(ctx, clock, reader)
+	}()
+
+	clock.Advance(clock.waitForTicker(), time.Second)
+	<-inFlight
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("readMeterForever returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("readMeterForever did not return after ctx was cancelled")
+	}
+	if _, stopped := clock.ticker(t).state(); !stopped {
+		t.Errorf("ticker was not stopped")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "fmt"
+
+// AuthError is returned when the gateway rejects our request as unauthenticated or unauthorized (HTTP 401/403).
+// It is distinct from other HTTP failures so that credential problems can be told apart from outages.
+type AuthError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed (%d) for HTTP GET %q: %s", e.StatusCode, e.URL, e.Status)
+}
+
+// DialError is returned when we could not complete the HTTP exchange with the gateway,
+// for example because it is unreachable or the connection dropped while reading the response.
+type DialError struct {
+	URL string
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("error doing HTTP GET %q: %v", e.URL, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// BadStatusError is returned when the gateway responds with an unexpected HTTP status code.
+type BadStatusError struct {
+	URL    string
+	Code   int
+	Status string
+}
+
+func (e *BadStatusError) Error() string {
+	return fmt.Sprintf("unexpected result %d from HTTP GET %q: %s", e.Code, e.URL, e.Status)
+}
+
+// ParseError is returned when the gateway response could not be parsed.
+type ParseError struct {
+	URL string
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("error parsing %q data: %v", e.URL, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ResponseTooLargeError is returned when the gateway response body exceeds the size we are willing to read.
+type ResponseTooLargeError struct {
+	URL   string
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response from HTTP GET %q exceeds %d bytes", e.URL, e.Limit)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/justinsb/experiments-slog/energymonitor/attrs"
+	"golang.org/x/exp/slog"
+)
+
+// eventsHandler streams each new Reading to the client as a Server-Sent Event,
+// for lightweight live dashboards.
+type eventsHandler struct{}
+
+func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, unsubscribe := readings.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			// Client disconnected (or server shutting down)
+			return
+		case reading := <-ch:
+			b, err := json.Marshal(reading)
+			if err != nil {
+				slog.Error("error serializing reading", attrs.Error(err))
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
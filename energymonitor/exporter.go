@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// droppedSpansExporter wraps a SpanExporter, counting spans that are lost before reaching the collector:
+// because their export failed (for example during a collector outage; the error itself is reported to
+// the otel error handler), or because the batch span processor's queue was full, so it dropped them.
+// SDK v1.10 doesn't expose the latter count, so the exporter is also told about each span as it is
+// queued (see Processor). The queue is exported in order, so a queued span that an export skips over
+// was dropped.
+type droppedSpansExporter struct {
+	sdktrace.SpanExporter
+
+	mutex sync.Mutex
+	// queued is the sampled spans handed to the batch span processor and not yet exported, in queue order.
+	queued []spanKey
+}
+
+// spanKey identifies a span.
+type spanKey struct {
+	traceID trace.TraceID
+	spanID  trace.SpanID
+}
+
+func keyOf(s sdktrace.ReadOnlySpan) spanKey {
+	return spanKey{traceID: s.SpanContext().TraceID(), spanID: s.SpanContext().SpanID()}
+}
+
+// Processor wraps bsp, the batch span processor exporting to e, so that e sees the spans it queues.
+func (e *droppedSpansExporter) Processor(bsp sdktrace.SpanProcessor) sdktrace.SpanProcessor {
+	return &queuedSpansProcessor{SpanProcessor: bsp, exporter: e}
+}
+
+func (e *droppedSpansExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if dropped := e.dequeue(spans); dropped > 0 {
+		slog.Warn("spans dropped because the export queue was full", slog.Int64("count", dropped))
+		// Metrics are initialized after the tracer provider.
+		if droppedSpans != nil {
+			droppedSpans.Add(ctx, dropped, attribute.String("reason", "queue_full"))
+		}
+	}
+
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	if err != nil {
+		if droppedSpans != nil {
+			droppedSpans.Add(ctx, int64(len(spans)), attribute.String("reason", "export_failed"))
+		}
+	}
+	return err
+}
+
+// dequeue removes spans from queued, returning how many spans queued ahead of them were skipped,
+// and so were dropped by the batch span processor.
+func (e *droppedSpansExporter) dequeue(spans []sdktrace.ReadOnlySpan) int64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var dropped int64
+	for _, s := range spans {
+		key := keyOf(s)
+		for i, queued := range e.queued {
+			if queued == key {
+				dropped += int64(i)
+				e.queued = e.queued[i+1:]
+				break
+			}
+		}
+	}
+	return dropped
+}
+
+// queuedSpansProcessor records the spans a batch span processor queues, for its droppedSpansExporter.
+type queuedSpansProcessor struct {
+	sdktrace.SpanProcessor
+	exporter *droppedSpansExporter
+}
+
+func (p *queuedSpansProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	// The batch span processor only queues sampled spans.
+	if !s.SpanContext().IsSampled() {
+		p.SpanProcessor.OnEnd(s)
+		return
+	}
+
+	// Queue the span while holding the lock, so that queued has the same order as the processor's
+	// queue; a full queue drops the span rather than blocking.
+	e := p.exporter
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.queued = append(e.queued, keyOf(s))
+	p.SpanProcessor.OnEnd(s)
+}
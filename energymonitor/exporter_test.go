@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// blockingExporter reports each export on exported, then blocks until release is closed.
+type blockingExporter struct {
+	exported chan string
+	release  chan struct{}
+}
+
+func (e *blockingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, s := range spans {
+		e.exported <- s.Name()
+	}
+	<-e.release
+	return nil
+}
+
+func (e *blockingExporter) Shutdown(ctx context.Context) error { return nil }
+
+// droppedSpansCount returns the dropped-spans count for reason.
+func droppedSpansCount(t *testing.T, reason string) int64 {
+	t.Helper()
+
+	rm, err := metricReader.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("failed to collect metrics: %v", err)
+	}
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != metricName("dropped-spans") {
+				continue
+			}
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if !ok {
+				t.Fatalf("metric %q is a %T, want an int64 sum", m.Name, m.Data)
+			}
+			for _, dp := range sum.DataPoints {
+				if v, _ := dp.Attributes.Value(attribute.Key("reason")); v.AsString() == reason {
+					total += dp.Value
+				}
+			}
+		}
+	}
+	return total
+}
+
+func TestDroppedSpansExporterQueueFull(t *testing.T) {
+	before := droppedSpansCount(t, "queue_full")
+
+	blocking := &blockingExporter{exported: make(chan string, 10), release: make(chan struct{})}
+	exporter := &droppedSpansExporter{SpanExporter: blocking}
+	bsp := sdktrace.NewBatchSpanProcessor(exporter, sdktrace.WithMaxQueueSize(1), sdktrace.WithMaxExportBatchSize(1))
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(exporter.Processor(bsp)))
+	tracer := tracerProvider.Tracer("test")
+
+	endSpan := func(name string) {
+		_, span := tracer.Start(context.Background(), name)
+		span.End()
+	}
+
+	// The first span is exported, blocking the exporter; the second fills the queue,
+	// and the next two are dropped.
+	endSpan("exported")
+	if got := <-blocking.exported; got != "exported" {
+		t.Fatalf("exported span %q, want %q", got, "exported")
+	}
+	endSpan("queued")
+	endSpan("dropped-1")
+	endSpan("dropped-2")
+
+	close(blocking.release)
+	if got := <-blocking.exported; got != "queued" {
+		t.Fatalf("exported span %q, want %q", got, "queued")
+	}
+	// The dropped spans are noticed when a span queued after them is exported.
+	endSpan("after")
+	if got := <-blocking.exported; got != "after" {
+		t.Fatalf("exported span %q, want %q", got, "after")
+	}
+	if err := tracerProvider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down tracer provider: %v", err)
+	}
+
+	if got := droppedSpansCount(t, "queue_full") - before; got != 2 {
+		t.Errorf("counted %d spans dropped because the queue was full, want 2", got)
+	}
+}
@@ -0,0 +1,105 @@
+package kslog
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RepeatCountKey is the attribute key counting how many identical consecutive
+// events a span event stands for; see WithCoalescedRepeats.
+const RepeatCountKey = "repeat_count"
+
+// WithCoalescedRepeats coalesces identical consecutive span events (same message and
+// attributes) into a single event, with a RepeatCountKey attribute counting them, for
+// example a message logged on every tick of a polling loop. An event is held back until
+// a different event is logged on the span, or the span is ended.
+// It applies to spans started with LogTracer.Start, whose returned span flushes the
+// held event when ended; it is ignored by NewHandler.
+func WithCoalescedRepeats() Option {
+	return func(c *handlerConfig) {
+		c.coalesceRepeats = true
+	}
+}
+
+// spanEvent is a span event, ready to be added to a span.
+type spanEvent struct {
+	name  string
+	time  time.Time
+	attrs []attribute.KeyValue
+	// errs are recorded as exceptions, following the event.
+	errs []error
+}
+
+// add adds the event (and its exceptions) to span; count is the number of
+// identical events it stands for.
+func (e *spanEvent) add(span trace.Span, count int) {
+	attrs := e.attrs
+	if count > 1 {
+		attrs = append(attrs[:len(attrs):len(attrs)], attribute.Int(RepeatCountKey, count))
+	}
+	span.AddEvent(e.name, trace.WithTimestamp(e.time), trace.WithAttributes(attrs...))
+	for _, err := range e.errs {
+		span.RecordError(err, trace.WithTimestamp(e.time))
+	}
+}
+
+// sameAs reports whether e repeats other: the same name and attributes, and errors
+// with the same messages.
+func (e *spanEvent) sameAs(other *spanEvent) bool {
+	if e.name != other.name || len(e.attrs) != len(other.attrs) || len(e.errs) != len(other.errs) {
+		return false
+	}
+	for i := range e.attrs {
+		if e.attrs[i] != other.attrs[i] {
+			return false
+		}
+	}
+	for i := range e.errs {
+		if e.errs[i].Error() != other.errs[i].Error() {
+			return false
+		}
+	}
+	return true
+}
+
+// coalescingSpan is a span that coalesces identical consecutive events from its
+// handlers; see WithCoalescedRepeats. End adds the event still held back.
+type coalescingSpan struct {
+	trace.Span
+
+	mutex   sync.Mutex
+	pending *spanEvent
+	count   int
+}
+
+// addEvent adds e to the span, unless it repeats the event held back.
+func (s *coalescingSpan) addEvent(e *spanEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pending != nil && e.sameAs(s.pending) {
+		s.count++
+		return
+	}
+	s.flushLocked()
+	s.pending, s.count = e, 1
+}
+
+func (s *coalescingSpan) flushLocked() {
+	if s.pending != nil {
+		s.pending.add(s.Span, s.count)
+		s.pending, s.count = nil, 0
+	}
+}
+
+// End adds the event held back, then ends the span.
+func (s *coalescingSpan) End(options ...trace.SpanEndOption) {
+	s.mutex.Lock()
+	s.flushLocked()
+	s.mutex.Unlock()
+
+	s.Span.End(options...)
+}
@@ -0,0 +1,26 @@
+package kslog
+
+import (
+	"context"
+
+	"golang.org/x/exp/slog"
+)
+
+// contextKey is the context key for the logger; see NewContext.
+type contextKey struct{}
+
+// NewContext returns a context that carries logger, for FromContext.
+// LogTracer.Start stores the span's logger this way.
+// (slog itself used to provide this, but no longer does.)
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger stored in ctx by NewContext,
+// or the default logger if there is none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
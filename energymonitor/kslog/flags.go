@@ -1,7 +1,115 @@
 package kslog
 
-import "flag"
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
 
+	"golang.org/x/exp/slog"
+)
+
+// InitFlags registers the kslog flags on flagset, or on flag.CommandLine if flagset is nil:
+//
+//	-log-level        minimum level recorded: debug, info, warn or error (see logLevel)
+//	-log-format       format of the stderr echo: text or json (see LogFormat)
+//	-log-add-source   add the source location to span events and stderr (see SetAddSource)
+//	-log-redact-keys  attribute keys whose values are redacted (see SetRedactedKeys)
 func InitFlags(flagset *flag.FlagSet) {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+	flagset.Var(&logFormat, "log-format", "format of log output to stderr: text or json")
+	flagset.Func("log-level", "minimum level of logs recorded: debug, info, warn or error (default info)", func(s string) error {
+		level, err := parseLevel(s)
+		if err != nil {
+			return err
+		}
+		logLevel.Set(level)
+		return nil
+	})
+	flagset.Var(addSourceFlag{}, "log-add-source", "add the source file, line and function of each log call to span events and stderr")
+	flagset.Func("log-redact-keys", "comma-separated attribute keys (or globs, e.g. *.token) whose values are replaced with REDACTED in logs and spans", func(s string) error {
+		var patterns []string
+		for _, pattern := range strings.Split(s, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+		return SetRedactedKeys(patterns)
+	})
+}
+
+// LogFormat is the format of logs written to stderr.
+// It implements flag.Value.
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+var logFormat = LogFormatText
+
+func (f *LogFormat) String() string {
+	return string(*f)
+}
+
+// Set changes the log format, reconfiguring the stderr handler and the default slog logger.
+func (f *LogFormat) Set(s string) error {
+	v := LogFormat(s)
+	switch v {
+	case LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q (must be text or json)", s)
+	}
+
+	configMutex.Lock()
+	*f = v
+	alsoLogToStderr = newStderrHandler()
+	stderr := alsoLogToStderr
+	configMutex.Unlock()
+
+	slog.SetDefault(slog.New(stderr))
+	return nil
+}
+
+// addSourceFlag is the flag.Value for -log-add-source, backed by SetAddSource.
+type addSourceFlag struct{}
+
+func (addSourceFlag) String() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return strconv.FormatBool(addSource)
+}
+
+func (addSourceFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	SetAddSource(v)
+	return nil
+}
+
+func (addSourceFlag) IsBoolFlag() bool { return true }
+
+// logLevel is the minimum level of logs recorded, both to spans and to stderr, set by -log-level.
+// A LevelVar can be changed while logging, so it does not need configMutex.
+var logLevel slog.LevelVar
 
+// parseLevel parses a level name, as accepted by -log-level.
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q (must be debug, info, warn or error)", s)
+	}
 }
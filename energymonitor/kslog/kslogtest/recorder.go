@@ -0,0 +1,38 @@
+// Package kslogtest provides helpers for testing code instrumented with kslog.
+package kslogtest
+
+import (
+	"github.com/justinsb/experiments-slog/energymonitor/kslog"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// SpanRecorder captures spans synchronously as they end, so tests can assert
+// on span structure (children, events, attributes) without waiting for a batch export.
+type SpanRecorder struct {
+	*tracetest.SpanRecorder
+
+	// Provider is the TracerProvider whose spans are recorded.
+	// To capture spans from code using kslog.Tracer, register it with otel.SetTracerProvider
+	// before the code under test starts any spans.
+	Provider *sdktrace.TracerProvider
+}
+
+// NewSpanRecorder returns a SpanRecorder with a TracerProvider that samples and records every span.
+func NewSpanRecorder() *SpanRecorder {
+	// tracetest.SpanRecorder is itself a synchronous SpanProcessor.
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(recorder),
+	)
+	return &SpanRecorder{
+		SpanRecorder: recorder,
+		Provider:     provider,
+	}
+}
+
+// Tracer returns a LogTracer whose spans are recorded.
+func (r *SpanRecorder) Tracer(name string, opts ...kslog.Option) *kslog.LogTracer {
+	return kslog.TracerFromProvider(r.Provider, name, opts...)
+}
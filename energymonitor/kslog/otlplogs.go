@@ -0,0 +1,251 @@
+package kslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	collectorlogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// LogEmitter receives the log records built by a handler from NewLogRecordHandler.
+// OTLPLogExporter sends them to an OTLP collector.
+//
+// The OpenTelemetry Go logs API (and SDK) don't exist at the version we use,
+// so this stands in for a log.Logger, emitting the OTLP protocol type directly.
+type LogEmitter interface {
+	// Emit is called with each record; it must not block, and must not retain ctx.
+	Emit(ctx context.Context, record *logspb.LogRecord)
+}
+
+// NewLogRecordHandler returns a handler that emits logs as OTLP log records through emitter,
+// rather than as span events, so they reach the logs pipeline even without an active span.
+// Records are correlated with the span on the logging call's context, if any; when the
+// handler is on the context passed to LogTracer.Start, the span logger forwards its records
+// here with the span, so they are recorded both as span events and as log records.
+//
+// Records are also echoed to stderr, and the attribute options (key mapping, redaction and
+// the limits) apply as they do to span events; the span-specific options have no effect.
+func NewLogRecordHandler(emitter LogEmitter, opts ...Option) slog.Handler {
+	return &slogHandler{
+		handlerConfig: newHandlerConfig(opts),
+		span:          trace.SpanFromContext(context.Background()),
+		emitter:       emitter,
+	}
+}
+
+// emitLogRecord converts r to an OTLP log record and emits it, for NewLogRecordHandler.
+func (h *slogHandler) emitLogRecord(ctx context.Context, r slog.Record, mapping map[string]string, redacted []string, policy DuplicateKeyPolicy, withSource bool) {
+	attrs := make([]attribute.KeyValue, 0, len(h.baggage)+len(h.attrs)+r.NumAttrs()+1)
+	attrs, eventName, _ := h.appendAttributes(attrs, ctx, r, mapping, redacted, withSource)
+	if eventName != "" {
+		// Log records have a body, so the event name is just an attribute.
+		attrs = append(attrs, attribute.String(EventNameKey, eventName))
+	}
+	attrs = h.limitAttributes(attrs, policy)
+
+	record := &logspb.LogRecord{
+		TimeUnixNano:         uint64(r.Time.UnixNano()),
+		ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+		SeverityNumber:       logspb.SeverityNumber(severityNumber(r.Level)),
+		SeverityText:         r.Level.String(),
+		Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: r.Message}},
+		Attributes:           keyValues(attrs),
+	}
+	if sc := h.spanContext(ctx); sc.IsValid() {
+		traceID, spanID := sc.TraceID(), sc.SpanID()
+		record.TraceId = traceID[:]
+		record.SpanId = spanID[:]
+		record.Flags = uint32(sc.TraceFlags())
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	h.emitter.Emit(ctx, record)
+}
+
+// keyValues converts OpenTelemetry attributes to their OTLP protocol form.
+func keyValues(attrs []attribute.KeyValue) []*commonpb.KeyValue {
+	kvs := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		value := &commonpb.AnyValue{}
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			value.Value = &commonpb.AnyValue_BoolValue{BoolValue: kv.Value.AsBool()}
+		case attribute.INT64:
+			value.Value = &commonpb.AnyValue_IntValue{IntValue: kv.Value.AsInt64()}
+		case attribute.FLOAT64:
+			value.Value = &commonpb.AnyValue_DoubleValue{DoubleValue: kv.Value.AsFloat64()}
+		case attribute.STRING:
+			value.Value = &commonpb.AnyValue_StringValue{StringValue: kv.Value.AsString()}
+		default:
+			// Slices; the handlers don't produce them, but resources may have them.
+			value.Value = &commonpb.AnyValue_StringValue{StringValue: kv.Value.Emit()}
+		}
+		kvs = append(kvs, &commonpb.KeyValue{Key: string(kv.Key), Value: value})
+	}
+	return kvs
+}
+
+const (
+	// DefaultLogQueueSize is the maximum number of log records OTLPLogExporter buffers;
+	// further records are dropped until the queue drains.
+	DefaultLogQueueSize = 2048
+
+	// DefaultLogBatchSize is the maximum number of log records OTLPLogExporter sends in one export.
+	DefaultLogBatchSize = 512
+
+	// DefaultLogExportInterval is how often OTLPLogExporter exports the records buffered so far.
+	DefaultLogExportInterval = 5 * time.Second
+)
+
+// OTLPLogExporter is a LogEmitter that batches log records and exports them to an OTLP
+// collector over GRPC, in the background. Export errors (and dropped records) are reported
+// to the otel error handler. Call Shutdown to flush the buffered records on exit.
+type OTLPLogExporter struct {
+	client   collectorlogspb.LogsServiceClient
+	headers  metadata.MD
+	resource *resourcepb.Resource
+	scope    *commonpb.InstrumentationScope
+
+	// flush is signalled when a full batch is buffered.
+	flush chan struct{}
+	// stop is closed by Shutdown, to stop the export loop; done is closed when it has stopped.
+	stop chan struct{}
+	done chan struct{}
+	// shutdown ensures Shutdown only stops the export loop once.
+	shutdown sync.Once
+
+	mutex   sync.Mutex
+	queue   []*logspb.LogRecord
+	dropped int
+}
+
+// NewOTLPLogExporter returns an OTLPLogExporter that sends log records over conn,
+// with the given resource and headers (for example API keys), and starts exporting.
+func NewOTLPLogExporter(conn grpc.ClientConnInterface, res *resource.Resource, headers map[string]string) *OTLPLogExporter {
+	e := &OTLPLogExporter{
+		client:   collectorlogspb.NewLogsServiceClient(conn),
+		headers:  metadata.New(headers),
+		resource: &resourcepb.Resource{Attributes: keyValues(res.Attributes())},
+		scope:    &commonpb.InstrumentationScope{Name: "github.com/justinsb/experiments-slog/energymonitor/kslog"},
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Emit buffers record for export, dropping it if the queue is full.
+func (e *OTLPLogExporter) Emit(_ context.Context, record *logspb.LogRecord) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.queue) >= DefaultLogQueueSize {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, record)
+	if len(e.queue) >= DefaultLogBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports the buffered records, periodically or when a batch is full, until Shutdown.
+func (e *OTLPLogExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(DefaultLogExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		if err := e.export(context.Background()); err != nil {
+			otel.Handle(err)
+		}
+	}
+}
+
+// export sends the buffered records, in batches, giving up when ctx is done.
+func (e *OTLPLogExporter) export(ctx context.Context) error {
+	e.mutex.Lock()
+	records := e.queue
+	dropped := e.dropped
+	e.queue = nil
+	e.dropped = 0
+	e.mutex.Unlock()
+
+	if dropped != 0 {
+		otel.Handle(fmt.Errorf("dropped %d log records because the export queue was full", dropped))
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, e.headers)
+	for len(records) != 0 {
+		n := len(records)
+		if n > DefaultLogBatchSize {
+			n = DefaultLogBatchSize
+		}
+		batch := records[:n]
+		records = records[n:]
+
+		request := &collectorlogspb.ExportLogsServiceRequest{
+			ResourceLogs: []*logspb.ResourceLogs{{
+				Resource: e.resource,
+				ScopeLogs: []*logspb.ScopeLogs{{
+					Scope:      e.scope,
+					LogRecords: batch,
+				}},
+			}},
+		}
+		if _, err := e.client.Export(ctx, request); err != nil {
+			return fmt.Errorf("failed to export %d log records: %w", len(batch)+len(records), err)
+		}
+	}
+	return nil
+}
+
+// ErrLogExporterShutdown is returned by OTLPLogExporter.Shutdown if it has already been called.
+var ErrLogExporterShutdown = errors.New("log exporter already shut down")
+
+// Shutdown stops the background export and exports the remaining records,
+// giving up when ctx is done. Records emitted after Shutdown are not exported.
+// Later calls return ErrLogExporterShutdown.
+func (e *OTLPLogExporter) Shutdown(ctx context.Context) error {
+	first := false
+	e.shutdown.Do(func() {
+		first = true
+		close(e.stop)
+	})
+	if !first {
+		return ErrLogExporterShutdown
+	}
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return e.export(ctx)
+}
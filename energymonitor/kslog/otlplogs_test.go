@@ -0,0 +1,54 @@
+package kslog_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/justinsb/experiments-slog/energymonitor/kslog"
+	"go.opentelemetry.io/otel/sdk/resource"
+	collectorlogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeLogsConn is a grpc connection that records the log exports sent over it.
+type fakeLogsConn struct {
+	mutex   sync.Mutex
+	records []*logspb.LogRecord
+}
+
+func (c *fakeLogsConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rl := range args.(*collectorlogspb.ExportLogsServiceRequest).GetResourceLogs() {
+		for _, sl := range rl.GetScopeLogs() {
+			c.records = append(c.records, sl.GetLogRecords()...)
+		}
+	}
+	return nil
+}
+
+func (c *fakeLogsConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, errors.New("streams are not supported")
+}
+
+func TestOTLPLogExporterShutdownTwice(t *testing.T) {
+	conn := &fakeLogsConn{}
+	exporter := kslog.NewOTLPLogExporter(conn, resource.Empty(), nil)
+	exporter.Emit(context.Background(), &logspb.LogRecord{SeverityText: "INFO"})
+
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := exporter.Shutdown(context.Background()); !errors.Is(err, kslog.ErrLogExporterShutdown) {
+		t.Errorf("second Shutdown returned %v, want %v", err, kslog.ErrLogExporterShutdown)
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if len(conn.records) != 1 {
+		t.Errorf("exported %d log records, want 1", len(conn.records))
+	}
+}
@@ -0,0 +1,77 @@
+package kslog
+
+import (
+	"sync"
+	"time"
+)
+
+// EventsDroppedKey is the attribute key counting the span events dropped by
+// WithEventRateLimit since the previous event that was recorded.
+const EventsDroppedKey = "log.events_dropped"
+
+// WithEventRateLimit limits the span events recorded by the tracer (across all its spans)
+// to eventsPerSecond, with bursts of up to that many events; logs beyond the limit are
+// still written to stderr, but are not recorded on the span. The next event that is
+// recorded carries the number dropped in the EventsDroppedKey attribute.
+// Zero or less (the default) means no limit.
+func WithEventRateLimit(eventsPerSecond float64) Option {
+	return func(c *handlerConfig) {
+		if eventsPerSecond <= 0 {
+			c.eventLimiter = nil
+			return
+		}
+		c.eventLimiter = newEventLimiter(eventsPerSecond)
+	}
+}
+
+// eventLimiter is a token bucket limiting the rate of span events.
+// It is shared by all the handlers of a tracer, so is safe for concurrent use.
+type eventLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+func newEventLimiter(eventsPerSecond float64) *eventLimiter {
+	burst := eventsPerSecond
+	if burst < 1 {
+		burst = 1
+	}
+	return &eventLimiter{
+		rate:   eventsPerSecond,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// allow reports whether an event may be recorded at now. If it may, it also returns
+// the number of events dropped since the last one that was allowed.
+func (l *eventLimiter) allow(now time.Time) (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.last.IsZero() {
+		if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+			l.tokens += elapsed * l.rate
+			if l.tokens > l.burst {
+				l.tokens = l.burst
+			}
+		}
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+
+	if l.tokens < 1 {
+		l.dropped++
+		return false, 0
+	}
+	l.tokens--
+	dropped := l.dropped
+	l.dropped = 0
+	return true, dropped
+}
@@ -2,49 +2,532 @@ package kslog
 
 import (
 	"context"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
 	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/justinsb/experiments-slog/energymonitor/attrs"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 )
 
-var alsoLogToStderr = slog.HandlerOptions{}.NewTextHandler(os.Stderr)
+// configMutex guards the package-level configuration below (and logFormat),
+// which can be changed while other goroutines are logging.
+// Handlers themselves are immutable once built, so are safe for concurrent use.
+var configMutex sync.RWMutex
 
-func Tracer(name string) *LogTracer {
-	otelTracer := otel.Tracer(name)
+var alsoLogToStderr = newStderrHandler()
+
+// keyMapping renames attribute keys as they are emitted; see SetKeyMapping.
+var keyMapping map[string]string
+
+// SetKeyMapping configures attribute keys to be renamed when logs are emitted
+// (both to spans and to stderr), for example to target a newer semantic
+// conventions version without changing call sites. It should be called
+// during startup, before logging.
+func SetKeyMapping(m map[string]string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	keyMapping = m
+	alsoLogToStderr = newStderrHandler()
+}
+
+// addSource adds the source location to all logs; see SetAddSource.
+var addSource bool
+
+// SetAddSource configures whether logs record where they were logged from: the
+// code.filepath, code.lineno and code.function attributes on span events, and the
+// source on stderr. It applies to all tracers, in addition to WithHandlerOptions.
+// It should be called during startup, before logging.
+func SetAddSource(enabled bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	addSource = enabled
+	alsoLogToStderr = newStderrHandler()
+}
+
+// RedactedValue replaces the value of attributes whose keys are redacted; see SetRedactedKeys.
+const RedactedValue = "REDACTED"
+
+// redactedKeys are the key patterns whose values are redacted; see SetRedactedKeys.
+var redactedKeys []string
+
+// SetRedactedKeys configures attributes whose values must never be emitted (for example
+// tokens, or URLs that may contain credentials); their values are replaced with RedactedValue,
+// both on spans and on stderr. Each pattern is an exact key, or a glob as understood by
+// path.Match (e.g. "*.token"). A key matches if it matches before or after SetKeyMapping renames it;
+// keys in groups are matched by their full dotted key (e.g. "http.token").
+// It should be called during startup, before logging.
+func SetRedactedKeys(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	redactedKeys = patterns
+	alsoLogToStderr = newStderrHandler()
+	return nil
+}
+
+// isRedacted reports whether any of keys matches one of patterns.
+func isRedacted(patterns []string, keys ...string) bool {
+	for _, pattern := range patterns {
+		for _, key := range keys {
+			if matched, _ := path.Match(pattern, key); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replaceKey applies the key mapping and redaction to attr.
+func replaceKey(mapping map[string]string, redacted []string, attr slog.Attr) slog.Attr {
+	key := mapKey(mapping, attr.Key)
+	if isRedacted(redacted, attr.Key, key) {
+		return slog.String(key, RedactedValue)
+	}
+	attr.Key = key
+	return attr
+}
+
+func mapKey(mapping map[string]string, key string) string {
+	if mapped, ok := mapping[key]; ok {
+		return mapped
+	}
+	return key
+}
+
+// newStderrHandler builds the handler that mirrors logs to stderr, in the configured format.
+// The caller must hold configMutex (or be in package initialization).
+func newStderrHandler() slog.Handler {
+	opts := slog.HandlerOptions{Level: &logLevel, AddSource: addSource}
+	if mapping, redacted := keyMapping, redactedKeys; len(mapping) != 0 || len(redacted) != 0 {
+		// Keys in groups are redacted by their full dotted keys before they get here (see forward).
+		opts.ReplaceAttr = func(_ []string, a slog.Attr) slog.Attr {
+			return replaceKey(mapping, redacted, a)
+		}
+	}
+	if logFormat == LogFormatJSON {
+		return opts.NewJSONHandler(os.Stderr)
+	}
+	return opts.NewTextHandler(os.Stderr)
+}
+
+// Option configures the handler that records logs on spans, for a LogTracer or NewHandler.
+type Option func(*handlerConfig)
+
+// handlerConfig is the configuration set by Options.
+type handlerConfig struct {
+	// opts are the options of the span handler; see WithHandlerOptions.
+	opts slog.HandlerOptions
+
+	// fallback replaces the stderr handler if hasFallback is set; see WithFallbackHandler.
+	fallback    slog.Handler
+	hasFallback bool
+
+	// maxStringLength is the maximum length of string attribute values on span events,
+	// or 0 for no limit; see WithMaxStringLength.
+	maxStringLength int
+
+	// maxAttributes is the maximum number of attributes on a span event,
+	// or 0 for no limit; see WithMaxAttributes.
+	maxAttributes int
+
+	// redactedKeys are key patterns redacted by this handler, in addition to
+	// the package-level ones; see WithRedactedKeys.
+	redactedKeys []string
+
+	// bytesEncoding is how []byte values are encoded on span events; see WithBytesEncoding.
+	bytesEncoding BytesEncoding
+
+	// baggageKeys are the baggage members recorded on span events; see WithBaggageAttributes.
+	baggageKeys []string
+
+	// eventLimiter limits the rate of span events, if set; see WithEventRateLimit.
+	eventLimiter *eventLimiter
+
+	// coalesceRepeats coalesces identical consecutive span events; see WithCoalescedRepeats.
+	coalesceRepeats bool
+}
+
+// DefaultMaxStringLength is the default maximum length, in bytes, of string attribute
+// values on span events; see WithMaxStringLength.
+const DefaultMaxStringLength = 4096
+
+// DefaultMaxAttributes is the default maximum number of attributes on a span event; see WithMaxAttributes.
+const DefaultMaxAttributes = 128
+
+func newHandlerConfig(opts []Option) handlerConfig {
+	c := handlerConfig{
+		maxStringLength: DefaultMaxStringLength,
+		maxAttributes:   DefaultMaxAttributes,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithFallbackHandler sets the handler that log records are also written to, in addition
+// to the span, replacing the default text (or -log-format) handler on stderr.
+// A nil handler disables the echo entirely.
+// Key mapping is not applied to records written to a custom handler;
+// configure it on the handler (e.g. with ReplaceAttr) if needed.
+func WithFallbackHandler(handler slog.Handler) Option {
+	return func(c *handlerConfig) {
+		c.fallback = handler
+		c.hasFallback = true
+	}
+}
+
+// WithoutStderr disables mirroring log records to stderr, so they are only recorded on the span.
+// This avoids duplicating log volume when the trace backend is the log store.
+func WithoutStderr() Option {
+	return WithFallbackHandler(nil)
+}
+
+// WithHandlerOptions sets the options of the span handler.
+// Level sets the minimum level recorded (overriding -log-level), and AddSource adds
+// the code.filepath, code.lineno and code.function attributes to span events.
+// Other fields are ignored.
+func WithHandlerOptions(opts slog.HandlerOptions) Option {
+	return func(c *handlerConfig) {
+		c.opts = opts
+	}
+}
+
+// WithMaxStringLength sets the maximum length, in bytes, of string attribute values on
+// span events (DefaultMaxStringLength by default); longer values are cut short and end
+// with TruncatedMarker, as collectors may reject oversized events. Zero or less disables the limit.
+// It does not affect the stderr echo.
+func WithMaxStringLength(n int) Option {
+	return func(c *handlerConfig) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxStringLength = n
+	}
+}
+
+// WithMaxAttributes sets the maximum number of attributes on a span event
+// (DefaultMaxAttributes by default). If there are more, only the first n-1 are kept,
+// followed by the AttributesDroppedKey attribute with the number dropped.
+// Zero or less disables the limit. It does not affect the stderr echo.
+func WithMaxAttributes(n int) Option {
+	return func(c *handlerConfig) {
+		if n < 0 {
+			n = 0
+		}
+		c.maxAttributes = n
+	}
+}
+
+// WithRedactedKeys redacts attributes whose keys match any of patterns, as well as those
+// configured by SetRedactedKeys (or -log-redact-keys), which it is otherwise like:
+// values are replaced with RedactedValue before reaching the span, stderr or the
+// context's handler. Patterns match the full dotted key of attributes in groups, and a
+// matching group is redacted as a whole. Invalid patterns never match.
+func WithRedactedKeys(patterns ...string) Option {
+	return func(c *handlerConfig) {
+		c.redactedKeys = append(c.redactedKeys, patterns...)
+	}
+}
+
+// BytesEncoding is how []byte attribute values are encoded as strings on span events.
+type BytesEncoding int
+
+const (
+	// BytesBase64 encodes []byte values with standard base64. This is the default.
+	BytesBase64 BytesEncoding = iota
+	// BytesHex encodes []byte values as lowercase hex.
+	BytesHex
+)
+
+// encode returns b encoded as a string.
+func (e BytesEncoding) encode(b []byte) string {
+	if e == BytesHex {
+		return hex.EncodeToString(b)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// WithBytesEncoding sets how []byte values (e.g. slog.Any("payload", b)) are encoded on span events.
+// Note that values longer than WithMaxStringLength are still truncated, so can't be decoded.
+func WithBytesEncoding(encoding BytesEncoding) Option {
+	return func(c *handlerConfig) {
+		c.bytesEncoding = encoding
+	}
+}
+
+// WithBaggageAttributes records the values of the given OpenTelemetry baggage members
+// (for example request-scoped metadata such as a tenant) as attributes on every span event.
+// The baggage is read from the context of the logging call (e.g. Logger.InfoCtx) if
+// there is one, and otherwise from the context passed to LogTracer.Start; members that
+// are missing are omitted.
+func WithBaggageAttributes(keys ...string) Option {
+	return func(c *handlerConfig) {
+		c.baggageKeys = append(c.baggageKeys, keys...)
+	}
+}
+
+// baggageAttrs returns the members of the baggage on ctx named by keys, as attributes.
+func baggageAttrs(ctx context.Context, keys []string) []slog.Attr {
+	if len(keys) == 0 {
+		return nil
+	}
+	bag := baggage.FromContext(ctx)
+	var attrs []slog.Attr
+	for _, key := range keys {
+		if member := bag.Member(key); member.Key() != "" {
+			attrs = append(attrs, slog.String(key, member.Value()))
+		}
+	}
+	return attrs
+}
+
+// AttributesDroppedKey is the attribute key counting the attributes dropped from a
+// span event by WithMaxAttributes.
+const AttributesDroppedKey = "log.attributes_dropped"
+
+// TruncatedMarker ends string attribute values cut short by WithMaxStringLength.
+const TruncatedMarker = "…(truncated)"
+
+// truncateString cuts s to at most max bytes (if max is positive), including TruncatedMarker,
+// without splitting a UTF-8 sequence. If max is too small to hold the marker, s is cut short without it.
+func truncateString(s string, max int) string {
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+	marker := TruncatedMarker
+	if max < len(marker) {
+		marker = ""
+	}
+	n := max - len(marker)
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + marker
+}
+
+// Tracer returns a LogTracer backed by the global otel TracerProvider.
+// If no provider is registered, spans are non-recording and logs are only written to stderr.
+func Tracer(name string, opts ...Option) *LogTracer {
+	return &LogTracer{
+		otel:   otel.Tracer(name),
+		config: newHandlerConfig(opts),
+	}
+}
+
+// TracerFromProvider returns a LogTracer backed by the given TracerProvider, rather than the global one.
+func TracerFromProvider(provider trace.TracerProvider, name string, opts ...Option) *LogTracer {
 	return &LogTracer{
-		otel: otelTracer,
+		otel:   provider.Tracer(name),
+		config: newHandlerConfig(opts),
 	}
 }
 
+// NoopTracer returns a LogTracer whose spans are non-recording and whose logs are discarded,
+// for tests of code that takes a LogTracer, without registering a TracerProvider.
+// Records are still forwarded to the logger on the context passed to Start, if there is one.
+// opts are applied after WithoutStderr, so a test can pass WithFallbackHandler to see the logs.
+func NoopTracer(opts ...Option) *LogTracer {
+	opts = append([]Option{WithoutStderr()}, opts...)
+	return TracerFromProvider(trace.NewNoopTracerProvider(), "", opts...)
+}
+
 type LogTracer struct {
 	otel trace.Tracer
+
+	// config configures the handlers of the spans we start.
+	config handlerConfig
 }
 
 func (t *LogTracer) Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span, *slog.Logger) {
+	inner := parentHandler(ctx)
 	ctx, span := t.otel.Start(ctx, spanName, opts...)
-	// slogLogger := slog.FromContext(ctx)
+	if t.config.coalesceRepeats && span.IsRecording() {
+		span = &coalescingSpan{Span: span}
+		ctx = trace.ContextWithSpan(ctx, span)
+	}
 	logHandler := &slogHandler{
-		// inner: slogLogger,
-		span: span,
+		handlerConfig: t.config,
+		inner:         inner,
+		span:          span,
+		start:         time.Now(),
+		baggage:       baggageAttrs(ctx, t.config.baggageKeys),
 	}
 	slogLogger := slog.New(logHandler)
 
-	ctx = slog.NewContext(ctx, slogLogger)
+	ctx = NewContext(ctx, slogLogger)
 	return ctx, span, slogLogger
 }
 
+// StartWithLinks is like Start, but links the new span to the given spans, for example
+// the upstream traces of items in a batch being processed.
+// Unlike LinkedTraceIDKey, the links are recorded as real span links, as they are known at start.
+func (t *LogTracer) StartWithLinks(ctx context.Context, spanName string, links []trace.Link, opts ...trace.SpanStartOption) (context.Context, trace.Span, *slog.Logger) {
+	if len(links) != 0 {
+		opts = append(opts[:len(opts):len(opts)], trace.WithLinks(links...))
+	}
+	return t.Start(ctx, spanName, opts...)
+}
+
+// Finish ends span, after logging (to log) that the operation finished and how long it took,
+// in the DurationKey attribute. If *err is non-nil, it is logged at error level instead and the
+// span status is set to Error with the error as its description. It is intended to be deferred,
+// with err pointing at a named error result:
+//
+//	func read(ctx context.Context) (err error) {
+//		ctx, span, log := tracer.Start(ctx, "read")
+//		defer tracer.Finish(span, log, &err)
+//		...
+//	}
+//
+// The duration is measured from Start (or, for other loggers, from the span's start time
+// if the span exposes it); if neither is known, it is omitted.
+func (t *LogTracer) Finish(span trace.Span, log *slog.Logger, err *error) {
+	defer span.End()
+
+	var attrs []slog.Attr
+	if elapsed, ok := spanElapsed(span, log); ok {
+		attrs = append(attrs, slog.Duration(DurationKey, elapsed))
+	}
+
+	// Attribute the record to our caller, as Logger.LogAttrs would attribute it to us.
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+
+	level, msg := slog.LevelInfo, "operation finished"
+	if err != nil && *err != nil {
+		level, msg = slog.LevelError, "operation failed"
+		attrs = append(attrs, slog.Any(ErrorKey, *err))
+	}
+	handler := log.Handler()
+	if handler.Enabled(context.Background(), level) {
+		r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+		r.AddAttrs(attrs...)
+		_ = handler.Handle(context.Background(), r)
+	}
+	if level == slog.LevelError {
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+}
+
+// ErrorKey is the attribute key we use for errors, e.g. in Finish.
+// slog no longer adds the error to Logger.Error itself, so callers should also use it,
+// typically with attrs.Error: log.Error("failed", attrs.Error(err)).
+// Like any other key, it is renamed by SetKeyMapping.
+const ErrorKey = attrs.ErrorKey
+
+// DurationKey is the attribute key of the elapsed time logged by Finish.
+const DurationKey = "duration"
+
+// spanElapsed returns how long ago span started, if known.
+func spanElapsed(span trace.Span, log *slog.Logger) (time.Duration, bool) {
+	// Spans are compared by their span contexts: some span types (such as the global
+	// non-recording span) aren't comparable, so comparing the interfaces can panic.
+	if h, ok := log.Handler().(*slogHandler); ok && h.span.SpanContext().Equal(span.SpanContext()) && !h.start.IsZero() {
+		return time.Since(h.start), true
+	}
+	// Spans from the SDK expose their start time.
+	if s, ok := span.(interface{ StartTime() time.Time }); ok {
+		if start := s.StartTime(); !start.IsZero() {
+			return time.Since(start), true
+		}
+	}
+	return 0, false
+}
+
+// NewHandler returns a handler that records logs as events on span, for when the span
+// already exists (for example it was started elsewhere and is on the context), so there is
+// no need to start one with LogTracer.Start. Records are also echoed to stderr, as configured by opts.
+func NewHandler(span trace.Span, opts ...Option) slog.Handler {
+	return &slogHandler{
+		handlerConfig: newHandlerConfig(opts),
+		span:          span,
+	}
+}
+
+// parentHandler returns the handler of the logger on ctx, to which records are forwarded,
+// or nil if there is none (FromContext falls back to the default logger).
+// For a logger from an enclosing span, it is that span's parent handler, so records
+// reach it once rather than through every enclosing span.
+func parentHandler(ctx context.Context) slog.Handler {
+	logger := FromContext(ctx)
+	if logger == slog.Default() {
+		return nil
+	}
+	if h, ok := logger.Handler().(*slogHandler); ok && h.emitter == nil {
+		return h.inner
+	}
+	return logger.Handler()
+}
+
+// slogHandler records logs as events on a span.
+// It is immutable once built: WithAttrs and WithGroup return copies that don't share
+// mutable state, so it is safe for concurrent use (the span itself is concurrency-safe).
 type slogHandler struct {
-	opts slog.HandlerOptions
+	handlerConfig
 	span trace.Span
+
+	// start is when Start started the span, or zero if unknown (see Finish).
+	start time.Time
+
+	// baggage are the baggage members captured by Start; see WithBaggageAttributes.
+	baggage []slog.Attr
+
+	// inner is the handler of the logger that was on the context when the span started.
+	// If set, records are forwarded to it, and it replaces the default stderr echo.
+	inner slog.Handler
+
+	// attrs are the attributes added with WithAttrs, which precede the record's own attributes.
+	// They are already wrapped in any groups that were open when they were added.
+	attrs []slog.Attr
+
+	// groups are the groups opened with WithGroup, which qualify the record's attributes.
+	groups []string
+
+	// emitter, if set, receives the records as OTLP log records instead of span events;
+	// see NewLogRecordHandler.
+	emitter LogEmitter
+}
+
+// spanContext returns the span context that records are correlated with: that of the
+// handler's span, or else that of the span on ctx (which may be nil).
+func (h *slogHandler) spanContext(ctx context.Context) trace.SpanContext {
+	if sc := h.span.SpanContext(); sc.IsValid() || ctx == nil {
+		return sc
+	}
+	return trace.SpanContextFromContext(ctx)
 }
 
 // Enabled reports whether the handler handles records at the given level.
-// The handler ignores records whose level is lower.
-func (h *slogHandler) Enabled(level slog.Level) bool {
-	minLevel := slog.InfoLevel
+// The handler ignores records whose level is lower than the -log-level flag,
+// or than the Level in WithHandlerOptions, if set.
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := logLevel.Level()
 	if h.opts.Level != nil {
 		minLevel = h.opts.Level.Level()
 	}
@@ -53,70 +536,543 @@ func (h *slogHandler) Enabled(level slog.Level) bool {
 
 // Handle handles the Record.
 // Handle methods that produce output should observe the following rules:
-//   - If r.Time() is the zero time, ignore the time.
+//   - If r.Time is the zero time, ignore the time.
 //   - If an Attr's key is the empty string, ignore the Attr.
-func (h *slogHandler) Handle(r slog.Record) error {
-	if alsoLogToStderr.Enabled(r.Level()) {
-		alsoLogToStderr.Handle(r)
+//
+// We instead stamp a record with a zero time with the current time, so that
+// the span event and the stderr line always carry the same timestamp.
+//
+// ctx is the context passed to the logging call (e.g. Logger.InfoCtx), or nil;
+// it is passed on to the stderr and context handlers, and baggage is read from it if set.
+func (h *slogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r = positionalErrors(r)
+
+	// Snapshot the configuration, so we don't hold the lock while writing.
+	configMutex.RLock()
+	stderr, mapping, redacted, policy, withSource := alsoLogToStderr, keyMapping, redactedKeys, duplicateKeyPolicy, addSource
+	configMutex.RUnlock()
+	if len(h.redactedKeys) != 0 {
+		redacted = append(redacted[:len(redacted):len(redacted)], h.redactedKeys...)
 	}
 
-	var opts []trace.EventOption
-	msg := r.Message()
+	// The context's logger already writes the logs somewhere, so don't also echo to stderr.
+	if h.inner != nil {
+		stderr = nil
+	}
+	if h.hasFallback {
+		stderr = h.fallback
+	}
+	// stderr is nil if mirroring is disabled (see WithoutStderr).
+	if stderr != nil {
+		// Add the trace and span ids, so stderr lines can be joined to the trace.
+		// They go ahead of any groups, so they are never qualified by them.
+		if sc := h.spanContext(ctx); sc.IsValid() {
+			stderr = stderr.WithAttrs([]slog.Attr{
+				slog.String(TraceIDKey, sc.TraceID().String()),
+				slog.String(SpanIDKey, sc.SpanID().String()),
+			})
+		}
+		h.forward(ctx, stderr, r, mapping, redacted)
+	}
 
-	recordNumAttrs := r.NumAttrs()
-	attrs := make([]attribute.KeyValue, 0, recordNumAttrs+1)
+	var innerErr error
+	if h.inner != nil {
+		// Carry the span on the context, so the inner handler can correlate the record with it
+		// (for example a handler from NewLogRecordHandler).
+		innerCtx := ctx
+		if h.span.SpanContext().IsValid() {
+			if innerCtx == nil {
+				innerCtx = context.Background()
+			}
+			innerCtx = trace.ContextWithSpan(innerCtx, h.span)
+		}
+		innerErr = h.forward(innerCtx, h.inner, r, mapping, redacted)
+	}
 
+	if h.emitter != nil {
+		h.emitLogRecord(ctx, r, mapping, redacted, policy, withSource)
+		return innerErr
+	}
+
+	// If the span isn't recording (for example no TracerProvider is registered),
+	// the event would be discarded, so don't bother building it.
+	if !h.span.IsRecording() {
+		return innerErr
+	}
+
+	eventsDropped := 0
+	if h.eventLimiter != nil {
+		allowed, dropped := h.eventLimiter.allow(time.Now())
+		if !allowed {
+			// Still mark the span as failed; that doesn't add to the payload.
+			if r.Level >= slog.LevelError {
+				h.span.SetStatus(codes.Error, r.Message)
+			}
+			return innerErr
+		}
+		eventsDropped = dropped
+	}
+
+	attrs := make([]attribute.KeyValue, 0, len(h.baggage)+len(h.attrs)+r.NumAttrs()+3)
 	{
 		// level
-		attrs = append(attrs, attribute.String("log.level", r.Level().String()))
+		attrs = append(attrs, attribute.String("log.level", r.Level.String()))
+		attrs = append(attrs, attribute.Int("log.severity_number", severityNumber(r.Level)))
 	}
+	attrs, eventName, errs := h.appendAttributes(attrs, ctx, r, mapping, redacted, withSource)
 
-	// timestamp
-	if t := r.Time(); !t.IsZero() {
-		opts = append(opts, trace.WithTimestamp(t))
+	msg := r.Message
+	if eventName != "" {
+		attrs = append(attrs, attribute.String(MessageKey, msg))
+		msg = eventName
 	}
 
-	if recordNumAttrs != 0 {
-		r.Attrs(func(attr slog.Attr) {
-			valueKind := attr.Value.Kind()
-			switch valueKind {
-			case slog.StringKind:
-				attrs = append(attrs, attribute.String(attr.Key, attr.Value.String()))
-			case slog.Int64Kind:
-				attrs = append(attrs, attribute.Int64(attr.Key, attr.Value.Int64()))
-			case slog.Float64Kind:
-				attrs = append(attrs, attribute.Float64(attr.Key, attr.Value.Float64()))
-			// case slog.TimeKind:
-			// 	attrs = append(attrs, attribute.Int64(attr.Key, attr.Value.Int64()))
-			// case slog.AnyKind:
-			// 	if tm, ok := v.any.(encoding.TextMarshaler); ok {
-			// 		data, err := tm.MarshalText()
-			// 		if err != nil {
-			// 			return err
-			// 		}
-			// 		// TODO: avoid the conversion to string.
-			// 		s.appendString(string(data))
-			// 		return nil
-			// 	}
-			// 	s.appendString(fmt.Sprint(v.Any()))
+	// Mark the span as failed, so backends show which spans had errors.
+	if r.Level >= slog.LevelError {
+		h.span.SetStatus(codes.Error, r.Message)
+	}
+
+	if eventsDropped != 0 {
+		attrs = append(attrs, attribute.Int(EventsDroppedKey, eventsDropped))
+	}
+	attrs = h.limitAttributes(attrs, policy)
+
+	// Errors are recorded after the event, so exception events follow the log event
+	// they came from. The exception attributes carry the error message and type.
+	event := &spanEvent{name: msg, time: r.Time, attrs: attrs, errs: errs}
+	if span, ok := h.span.(*coalescingSpan); ok {
+		span.addEvent(event)
+	} else {
+		event.add(h.span, 1)
+	}
+
+	return innerErr
+}
+
+// appendAttributes appends the attributes of r (and of this handler) to attrs,
+// converted to OpenTelemetry attributes, with key mapping and redaction applied.
+// It also returns the EventNameKey value, if any (which is not appended), and the
+// error values among the attributes.
+func (h *slogHandler) appendAttributes(attrs []attribute.KeyValue, ctx context.Context, r slog.Record, mapping map[string]string, redacted []string, withSource bool) ([]attribute.KeyValue, string, []error) {
+	eventName := ""
+
+	// source location, using the OpenTelemetry semantic conventions
+	if h.opts.AddSource || withSource {
+		if file, line, function := sourceLocation(r); file != "" {
+			attrs = append(attrs, attribute.String("code.filepath", file))
+			attrs = append(attrs, attribute.Int("code.lineno", line))
+			if function != "" {
+				attrs = append(attrs, attribute.String("code.function", function))
+			}
+		}
+	}
+
+	// errs are the error values among the attributes, recorded as exceptions on the span.
+	var errs []error
+
+	// addAttr converts attr to OpenTelemetry attributes, flattening groups into dotted keys,
+	// since span events have a flat attribute model.
+	var addAttr func(prefix string, attr slog.Attr)
+	addAttr = func(prefix string, attr slog.Attr) {
+		attr.Value = attr.Value.Resolve()
+		if attr.Value.Kind() == slog.KindGroup {
+			groupPrefix := prefix
+			if attr.Key != "" {
+				if key := prefix + attr.Key; isRedacted(redacted, key, mapKey(mapping, key)) {
+					attrs = append(attrs, attribute.String(mapKey(mapping, key), RedactedValue))
+					return
+				}
+				groupPrefix += attr.Key + "."
+			}
+			for _, member := range attr.Value.Group() {
+				addAttr(groupPrefix, member)
+			}
+			return
+		}
+
+		attr.Key = prefix + attr.Key
+		attr = replaceKey(mapping, redacted, attr)
+		valueKind := attr.Value.Kind()
+		switch valueKind {
+		case slog.KindString:
+			if attr.Key == EventNameKey {
+				eventName = attr.Value.String()
+				return
+			}
+			attrs = append(attrs, attribute.String(attr.Key, attr.Value.String()))
+			if attr.Key == LinkedTraceIDKey {
+				h.linkTrace(attr.Value.String())
+			}
+		case slog.KindInt64:
+			attrs = append(attrs, attribute.Int64(attr.Key, attr.Value.Int64()))
+		case slog.KindFloat64:
+			attrs = append(attrs, attribute.Float64(attr.Key, attr.Value.Float64()))
+		case slog.KindUint64:
+			// OpenTelemetry has no uint64 type; values that don't fit in an int64 are
+			// recorded in decimal rather than wrapping negative.
+			if v := attr.Value.Uint64(); v <= math.MaxInt64 {
+				attrs = append(attrs, attribute.Int64(attr.Key, int64(v)))
+			} else {
+				attrs = append(attrs, attribute.String(attr.Key, strconv.FormatUint(v, 10)))
+			}
+		case slog.KindBool:
+			attrs = append(attrs, attribute.Bool(attr.Key, attr.Value.Bool()))
+		case slog.KindDuration:
+			// OpenTelemetry has no duration type; record integer nanoseconds under the same key,
+			// so the key still matches key mapping, redaction and dedup.
+			attrs = append(attrs, attribute.Int64(attr.Key, attr.Value.Duration().Nanoseconds()))
+		case slog.KindTime:
+			attrs = append(attrs, attribute.String(attr.Key, attr.Value.Time().Format(time.RFC3339Nano)))
+		case slog.KindAny:
+			switch v := attr.Value.Any().(type) {
+			case nil:
+				// For example a nil error passed explicitly.
+				attrs = append(attrs, attribute.String(attr.Key, "<nil>"))
+			case []byte:
+				attrs = append(attrs, attribute.String(attr.Key, h.bytesEncoding.encode(v)))
+			case error:
+				// fmt copes with a typed nil error whose Error method would panic.
+				attrs = append(attrs, attribute.String(attr.Key, fmt.Sprint(v)))
+				if !isNilValue(v) {
+					errs = append(errs, v)
+				}
+			case encoding.TextMarshaler:
+				if data, err := v.MarshalText(); err == nil {
+					attrs = append(attrs, attribute.String(attr.Key, string(data)))
+				} else {
+					attrs = append(attrs, attribute.String(attr.Key, fmt.Sprint(v)))
+				}
 			default:
-				slog.Warn("unhandled value kind", "kind", valueKind.String())
-				// *s.buf = v.append(*s.buf)
+				attrs = append(attrs, attribute.String(attr.Key, fmt.Sprint(v)))
 			}
+		default:
+			slog.Warn("unhandled value kind", "kind", valueKind.String())
+			// *s.buf = v.append(*s.buf)
+		}
+	}
+
+	// Prefer the baggage of the logging call's context, if any, to that captured by Start.
+	bag := h.baggage
+	if ctx != nil && len(h.baggageKeys) != 0 {
+		bag = baggageAttrs(ctx, h.baggageKeys)
+	}
+	for _, attr := range bag {
+		addAttr("", attr)
+	}
+	for _, attr := range h.attrs {
+		addAttr("", attr)
+	}
+	if r.NumAttrs() != 0 {
+		prefix := groupPrefix(h.groups)
+		r.Attrs(func(attr slog.Attr) {
+			addAttr(prefix, attr)
 		})
-		opts = append(opts, trace.WithAttributes(attrs...))
 	}
-	h.span.AddEvent(msg, opts...)
 
-	return nil
+	return attrs, eventName, errs
+}
+
+// limitAttributes applies the string length and attribute count limits (see
+// WithMaxStringLength and WithMaxAttributes) to attrs, after removing duplicate keys.
+func (h *slogHandler) limitAttributes(attrs []attribute.KeyValue, policy DuplicateKeyPolicy) []attribute.KeyValue {
+	if max := h.maxStringLength; max > 0 {
+		for i, kv := range attrs {
+			if kv.Value.Type() == attribute.STRING {
+				if v := kv.Value.AsString(); len(v) > max {
+					attrs[i] = attribute.String(string(kv.Key), truncateString(v, max))
+				}
+			}
+		}
+	}
+
+	attrs = dedupAttributes(attrs, policy)
+	if max := h.maxAttributes; max > 0 && len(attrs) > max {
+		// The count takes the place of the last attribute kept, so the event stays within max
+		// (the SDK itself silently drops attributes beyond its limit, 128 by default).
+		keep := max - 1
+		attrs = append(attrs[:keep], attribute.Int(AttributesDroppedKey, len(attrs)-keep))
+	}
+	return attrs
+}
+
+// groupPrefix returns the dotted prefix of keys in groups, e.g. "a.b." for groups a and b.
+func groupPrefix(groups []string) string {
+	if len(groups) == 0 {
+		return ""
+	}
+	return strings.Join(groups, ".") + "."
+}
+
+// redactAttrs returns attrs with the values of those whose keys (qualified by prefix)
+// match redacted replaced by RedactedValue, and whether any were. attrs is not modified.
+func redactAttrs(mapping map[string]string, redacted []string, prefix string, attrs []slog.Attr) ([]slog.Attr, bool) {
+	var out []slog.Attr
+	for i, attr := range attrs {
+		replaced, changed := attr, false
+		if attr.Value.Kind() == slog.KindGroup && attr.Key == "" {
+			var members []slog.Attr
+			if members, changed = redactAttrs(mapping, redacted, prefix, attr.Value.Group()); changed {
+				replaced = slog.Group(attr.Key, members...)
+			}
+		} else if key := prefix + attr.Key; isRedacted(redacted, key, mapKey(mapping, key)) {
+			replaced, changed = slog.String(attr.Key, RedactedValue), true
+		} else if attr.Value.Kind() == slog.KindGroup {
+			var members []slog.Attr
+			if members, changed = redactAttrs(mapping, redacted, key+".", attr.Value.Group()); changed {
+				replaced = slog.Group(attr.Key, members...)
+			}
+		}
+
+		if out == nil && changed {
+			out = make([]slog.Attr, i, len(attrs))
+			copy(out, attrs[:i])
+		}
+		if out != nil {
+			out = append(out, replaced)
+		}
+	}
+	if out == nil {
+		return attrs, false
+	}
+	return out, true
+}
+
+// redactRecord returns r with its attributes redacted as by redactAttrs.
+// slog records can't be modified in place, so a redacted record is rebuilt.
+func redactRecord(mapping map[string]string, redacted []string, prefix string, r slog.Record) slog.Record {
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(attr slog.Attr) {
+		attrs = append(attrs, attr)
+	})
+	attrs, changed := redactAttrs(mapping, redacted, prefix, attrs)
+	if !changed {
+		return r
+	}
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	out.AddAttrs(attrs...)
+	return out
+}
+
+// badKey is the key slog gives a value passed without a key, e.g. err in log.Error("failed", err).
+const badKey = "!BADKEY"
+
+// positionalErrors returns r with errors passed without a key, as Logger.Error took them before
+// slog changed its signature, given ErrorKey instead; nil errors passed that way are dropped.
+// Other values without keys are left as slog recorded them.
+func positionalErrors(r slog.Record) slog.Record {
+	found := false
+	r.Attrs(func(attr slog.Attr) {
+		if isPositionalError(attr) {
+			found = true
+		}
+	})
+	if !found {
+		return r
+	}
+
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(attr slog.Attr) {
+		if !isPositionalError(attr) {
+			out.AddAttrs(attr)
+			return
+		}
+		if v := attr.Value.Any(); v != nil {
+			out.AddAttrs(slog.Any(ErrorKey, v))
+		}
+	})
+	return out
+}
+
+// isPositionalError reports whether attr is an error (or nil) that slog recorded without a key.
+func isPositionalError(attr slog.Attr) bool {
+	if attr.Key != badKey || attr.Value.Kind() != slog.KindAny {
+		return false
+	}
+	switch attr.Value.Any().(type) {
+	case nil, error:
+		return true
+	}
+	return false
+}
+
+// sourceLocation returns the file, line and function where r was logged,
+// or empty values if r carries no location.
+func sourceLocation(r slog.Record) (file string, line int, function string) {
+	if r.PC == 0 {
+		return "", 0, ""
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+	return frame.File, frame.Line, frame.Function
+}
+
+// forward passes r to handler, with the attributes and groups added to this handler.
+// Attributes matching the redacted patterns are redacted first, by their full dotted keys.
+func (h *slogHandler) forward(ctx context.Context, handler slog.Handler, r slog.Record, mapping map[string]string, redacted []string) error {
+	if !handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	attrs := h.attrs
+	if len(redacted) != 0 {
+		attrs, _ = redactAttrs(mapping, redacted, "", attrs)
+		r = redactRecord(mapping, redacted, groupPrefix(h.groups), r)
+	}
+	if len(attrs) != 0 {
+		handler = handler.WithAttrs(attrs)
+	}
+	for _, group := range h.groups {
+		handler = handler.WithGroup(group)
+	}
+	return handler.Handle(ctx, r)
+}
+
+// isNilValue reports whether v is an interface holding a nil pointer (or other nil value),
+// for which methods such as Error may panic.
+func isNilValue(v any) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Interface, reflect.Chan:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// TraceIDKey and SpanIDKey are the attribute keys of the (hex) trace and span ids
+// added to logs echoed to stderr, for correlating them with the trace.
+const (
+	TraceIDKey = "trace_id"
+	SpanIDKey  = "span_id"
+)
+
+// EventNameKey is the attribute key that sets a stable span event name.
+//
+// By default the span event is named with the log message, which is
+// high-cardinality if the message embeds values, and some trace backends
+// index event names. When a record has an EventNameKey attribute (see
+// EventName), its value is used as the event name instead, and the
+// message is recorded in the MessageKey attribute.
+const EventNameKey = "event.name"
+
+// MessageKey is the attribute key holding the log message, when the event is named with EventNameKey.
+const MessageKey = "log.message"
+
+// EventName returns an attribute that names the span event for a log record; see EventNameKey.
+func EventName(name string) slog.Attr {
+	return slog.String(EventNameKey, name)
+}
+
+// DuplicateKeyPolicy controls how attributes that share a key on one record
+// (e.g. from both Logger.With and the call site) are emitted on the span event.
+type DuplicateKeyPolicy int
+
+const (
+	// LastValueWins keeps only the last value for each key. This is the default.
+	LastValueWins DuplicateKeyPolicy = iota
+	// FirstValueWins keeps only the first value for each key.
+	FirstValueWins
+	// KeepDuplicates emits every attribute, leaving it to the backend.
+	KeepDuplicates
+)
+
+var duplicateKeyPolicy = LastValueWins
+
+// SetDuplicateKeyPolicy configures how attributes with duplicate keys are handled.
+// It should be called during startup, before logging.
+func SetDuplicateKeyPolicy(policy DuplicateKeyPolicy) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	duplicateKeyPolicy = policy
+}
+
+// dedupAttributes removes attributes with duplicate keys according to policy,
+// keeping each key at the position it first appeared. It reuses the attrs slice.
+func dedupAttributes(attrs []attribute.KeyValue, policy DuplicateKeyPolicy) []attribute.KeyValue {
+	if policy == KeepDuplicates || len(attrs) < 2 {
+		return attrs
+	}
+
+	index := make(map[attribute.Key]int, len(attrs))
+	out := attrs[:0]
+	for _, kv := range attrs {
+		if i, found := index[kv.Key]; found {
+			if policy == LastValueWins {
+				out[i] = kv
+			}
+			continue
+		}
+		index[kv.Key] = len(out)
+		out = append(out, kv)
+	}
+	return out
 }
 
-// With returns a new Handler whose attributes consist of
+// LinkedTraceIDKey is the attribute key for the (hex) id of a related trace,
+// for example a downstream operation we kicked off.
+//
+// Ideally we would record a span link, but the OpenTelemetry API only accepts
+// links when the span is started. Instead, a valid trace id is also set as an
+// attribute on the span itself (not just the event), so the relationship is
+// searchable. If several are logged against one span, the last one wins.
+const LinkedTraceIDKey = "linked_trace_id"
+
+func (h *slogHandler) linkTrace(traceID string) {
+	if _, err := trace.TraceIDFromHex(traceID); err != nil {
+		return
+	}
+	h.span.SetAttributes(attribute.String(LinkedTraceIDKey, traceID))
+}
+
+// severityNumber maps a slog level to the OTLP log SeverityNumber.
+// slog levels are spaced to match OpenTelemetry, so this is an offset of 9:
+// Info maps to INFO (9), Warn to WARN (13) and Error to ERROR (17),
+// with levels below Info falling into the DEBUG and TRACE ranges.
+func severityNumber(level slog.Level) int {
+	n := int(level) + 9
+	if n < 1 {
+		n = 1
+	}
+	if n > 24 {
+		n = 24
+	}
+	return n
+}
+
+// WithAttrs returns a new Handler whose attributes consist of
 // the receiver's attributes concatenated with the arguments.
 // The Handler owns the slice: it may retain, modify or discard it.
-func (h *slogHandler) With(attrs []slog.Attr) slog.Handler {
-	return &slogHandler{
-		opts: h.opts,
-		span: h.span,
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	// Qualify attrs by the open groups now, as later groups must not apply to them.
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		attrs = []slog.Attr{slog.Group(h.groups[i], attrs...)}
 	}
+
+	// Copy, so handlers derived from the same parent don't share a backing array.
+	merged := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	merged = append(merged, h.attrs...)
+	merged = append(merged, attrs...)
+
+	// Copy the whole handler, so no field is lost (e.g. the emitter of NewLogRecordHandler).
+	c := *h
+	c.attrs = merged
+	return &c
+}
+
+// WithGroup returns a new Handler with the given group appended to
+// the receiver's existing groups.
+// Attribute keys are qualified by joining the group names with dots, matching
+// how group attributes are flattened. An empty name is ignored.
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	groups := make([]string, 0, len(h.groups)+1)
+	groups = append(groups, h.groups...)
+	groups = append(groups, name)
+
+	c := *h
+	c.groups = groups
+	return &c
 }
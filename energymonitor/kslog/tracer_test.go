@@ -0,0 +1,597 @@
+package kslog_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/justinsb/experiments-slog/energymonitor/attrs"
+	"github.com/justinsb/experiments-slog/energymonitor/kslog"
+	"github.com/justinsb/experiments-slog/energymonitor/kslog/kslogtest"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"golang.org/x/exp/slog"
+)
+
+// endedSpan returns the only span recorded by recorder.
+func endedSpan(t *testing.T, recorder *kslogtest.SpanRecorder) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d ended spans, want 1", len(ended))
+	}
+	return ended[0]
+}
+
+// eventAttributes returns the attributes of a span event, by key.
+func eventAttributes(event sdktrace.Event) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(event.Attributes))
+	for _, kv := range event.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+// TestConcurrentLogging logs into one span from many goroutines, deriving loggers
+// with With and WithGroup as they go; run it with -race.
+func TestConcurrentLogging(t *testing.T) {
+	recorder := kslogtest.NewSpanRecorder()
+	tracer := recorder.Tracer("test", kslog.WithoutStderr())
+
+	_, span, log := tracer.Start(context.Background(), "concurrent")
+	shared := log.With(slog.String("shared", "value"))
+
+	// The SDK keeps at most 128 events per span by default.
+	const goroutines = 20
+	const iterations = 3
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				grouped := shared.With(slog.Int("goroutine", i)).WithGroup("request")
+				grouped.Info("grouped", slog.Int("iteration", j))
+				shared.Info("shared", slog.Int("goroutine", i), slog.Int("iteration", j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	span.End()
+
+	events := endedSpan(t, recorder).Events()
+	if got, want := len(events), goroutines*iterations*2; got != want {
+		t.Fatalf("got %d span events, want %d", got, want)
+	}
+
+	seen := make(map[string]bool)
+	for _, event := range events {
+		attrs := eventAttributes(event)
+		if got := attrs["shared"].AsString(); got != "value" {
+			t.Errorf("event %q has shared=%q, want %q", event.Name, got, "value")
+		}
+		iteration := attrs["iteration"]
+		if event.Name == "grouped" {
+			// Attributes added before WithGroup are not qualified by the group.
+			iteration = attrs["request.iteration"]
+		}
+		key := fmt.Sprintf("%s/%d/%d", event.Name, attrs["goroutine"].AsInt64(), iteration.AsInt64())
+		if seen[key] {
+			t.Errorf("duplicate event %s", key)
+		}
+		seen[key] = true
+	}
+	if got, want := len(seen), goroutines*iterations*2; got != want {
+		t.Errorf("got %d distinct events, want %d", got, want)
+	}
+}
+
+// TestConcurrentLoggingFromContext logs into one span from many goroutines that share
+// the span's context, as code passing the context around does; run it with -race.
+func TestConcurrentLoggingFromContext(t *testing.T) {
+	recorder := kslogtest.NewSpanRecorder()
+	tracer := recorder.Tracer("test", kslog.WithoutStderr())
+
+	ctx, span, log := tracer.Start(context.Background(), "concurrent")
+
+	const goroutines = 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			kslog.FromContext(ctx).InfoCtx(ctx, "working", slog.Int("goroutine", i))
+		}(i)
+	}
+	wg.Wait()
+	var err error
+	tracer.Finish(span, log, &err)
+
+	seen := make(map[int64]bool)
+	for _, event := range endedSpan(t, recorder).Events() {
+		if event.Name != "working" {
+			continue
+		}
+		seen[eventAttributes(event)["goroutine"].AsInt64()] = true
+	}
+	if len(seen) != goroutines {
+		t.Errorf("got events from %d goroutines, want %d", len(seen), goroutines)
+	}
+}
+
+func TestMaxAttributes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []kslog.Option
+		max  int
+	}{
+		// The default is the SDK's own limit of 128 attributes per event, beyond which it drops them silently.
+		{name: "default", max: kslog.DefaultMaxAttributes},
+		{name: "configured", opts: []kslog.Option{kslog.WithMaxAttributes(50)}, max: 50},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := kslogtest.NewSpanRecorder()
+			tracer := recorder.Tracer("test", append([]kslog.Option{kslog.WithoutStderr()}, tc.opts...)...)
+
+			_, span, log := tracer.Start(context.Background(), "attributes")
+			const n = 200
+			var args []any
+			for i := 0; i < n; i++ {
+				args = append(args, slog.Int(fmt.Sprintf("attr%03d", i), i))
+			}
+			log.Info("many attributes", args...)
+			span.End()
+
+			events := endedSpan(t, recorder).Events()
+			if len(events) != 1 {
+				t.Fatalf("got %d span events, want 1", len(events))
+			}
+			event := events[0]
+			if got, want := len(event.Attributes), tc.max; got != want {
+				t.Fatalf("event has %d attributes, want %d", got, want)
+			}
+			if event.DroppedAttributeCount != 0 {
+				t.Errorf("the SDK dropped %d attributes", event.DroppedAttributeCount)
+			}
+
+			// The first attributes are kept, in order; the dropped count is last.
+			attrs := eventAttributes(event)
+			kept := 0
+			for i := 0; i < n; i++ {
+				v, ok := attrs[attribute.Key(fmt.Sprintf("attr%03d", i))]
+				if !ok {
+					break
+				}
+				if v.AsInt64() != int64(i) {
+					t.Errorf("attr%03d=%v, want %d", i, v.AsInt64(), i)
+				}
+				kept++
+			}
+			for i := kept; i < n; i++ {
+				if _, ok := attrs[attribute.Key(fmt.Sprintf("attr%03d", i))]; ok {
+					t.Errorf("attr%03d was kept after attr%03d was dropped", i, kept)
+				}
+			}
+			last := event.Attributes[len(event.Attributes)-1]
+			if last.Key != kslog.AttributesDroppedKey {
+				t.Fatalf("last attribute is %q, want %q", last.Key, kslog.AttributesDroppedKey)
+			}
+			if got, want := last.Value.AsInt64(), int64(n-kept); got != want {
+				t.Errorf("%s=%d, want %d", kslog.AttributesDroppedKey, got, want)
+			}
+			// Only the level attributes precede the record's own, and the count follows them.
+			if want := tc.max - 3; kept != want {
+				t.Errorf("kept %d of the record's attributes, want %d", kept, want)
+			}
+		})
+	}
+}
+
+// secret is the value of redacted attributes, which must not appear in any output.
+const secret = "hunter2"
+
+// loggedOutputs returns everything a span's events and the fallback handler recorded, as text.
+func loggedOutputs(t *testing.T, recorder *kslogtest.SpanRecorder, fallback *bytes.Buffer) map[string]string {
+	t.Helper()
+
+	var events strings.Builder
+	for _, event := range endedSpan(t, recorder).Events() {
+		events.WriteString(event.Name)
+		for _, kv := range event.Attributes {
+			fmt.Fprintf(&events, " %s=%s", kv.Key, kv.Value.Emit())
+		}
+		events.WriteString("\n")
+	}
+	return map[string]string{"span": events.String(), "stderr": fallback.String()}
+}
+
+func TestRedactedKeys(t *testing.T) {
+	recorder := kslogtest.NewSpanRecorder()
+	var fallback bytes.Buffer
+	tracer := recorder.Tracer("test",
+		kslog.WithFallbackHandler(slog.HandlerOptions{}.NewTextHandler(&fallback)),
+		kslog.WithRedactedKeys("token", "*_password"))
+
+	_, span, log := tracer.Start(context.Background(), "redaction")
+	log.Info("exact", slog.String("token", secret), slog.String("user", "alice"))
+	log.Info("glob", slog.String("db_password", secret))
+	log.With(slog.String("token", secret)).Info("with")
+	span.End()
+
+	for name, output := range loggedOutputs(t, recorder, &fallback) {
+		if strings.Contains(output, secret) {
+			t.Errorf("redacted value appears in %s output:\n%s", name, output)
+		}
+		for _, want := range []string{"token=" + kslog.RedactedValue, "db_password=" + kslog.RedactedValue, "user=alice"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("%s output does not contain %q:\n%s", name, want, output)
+			}
+		}
+	}
+}
+
+func TestRedactedKeysInGroups(t *testing.T) {
+	recorder := kslogtest.NewSpanRecorder()
+	var fallback bytes.Buffer
+	tracer := recorder.Tracer("test",
+		kslog.WithFallbackHandler(slog.HandlerOptions{}.NewTextHandler(&fallback)),
+		kslog.WithRedactedKeys("http.token", "auth.*", "headers"))
+
+	_, span, log := tracer.Start(context.Background(), "redaction")
+	log.WithGroup("http").Info("with group", slog.String("token", secret), slog.String("method", "GET"))
+	log.Info("inline group", slog.Group("auth", slog.String("password", secret)))
+	log.Info("whole group", slog.Group("headers", slog.String("authorization", secret)))
+	log.WithGroup("http").With(slog.String("token", secret)).Info("with group and attrs")
+	span.End()
+
+	for name, output := range loggedOutputs(t, recorder, &fallback) {
+		if strings.Contains(output, secret) {
+			t.Errorf("redacted value appears in %s output:\n%s", name, output)
+		}
+		for _, want := range []string{"http.token=" + kslog.RedactedValue, "auth.password=" + kslog.RedactedValue, "headers=" + kslog.RedactedValue, "http.method=GET"} {
+			if !strings.Contains(output, want) {
+				t.Errorf("%s output does not contain %q:\n%s", name, want, output)
+			}
+		}
+	}
+}
+
+// exceptions returns the exception events recorded on span.
+func exceptions(span sdktrace.ReadOnlySpan) []sdktrace.Event {
+	var events []sdktrace.Event
+	for _, event := range span.Events() {
+		if event.Name == "exception" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// TestPositionalErrors checks errors passed to Logger.Error without a key, as its
+// signature took them before slog changed it, are recorded under ErrorKey.
+func TestPositionalErrors(t *testing.T) {
+	recorder := kslogtest.NewSpanRecorder()
+	var fallback bytes.Buffer
+	tracer := recorder.Tracer("test", kslog.WithFallbackHandler(slog.HandlerOptions{}.NewTextHandler(&fallback)))
+
+	_, span, log := tracer.Start(context.Background(), "errors")
+	log.Error("failed", errors.New("boom"), slog.Int("attempt", 1))
+	log.Error("no error", nil)
+	span.End()
+
+	for name, output := range loggedOutputs(t, recorder, &fallback) {
+		if strings.Contains(output, "BADKEY") {
+			t.Errorf("%s output has a BADKEY attribute:\n%s", name, output)
+		}
+		if !strings.Contains(output, "error=boom") {
+			t.Errorf("%s output does not contain %q:\n%s", name, "error=boom", output)
+		}
+	}
+	if got := len(exceptions(endedSpan(t, recorder))); got != 1 {
+		t.Errorf("got %d exception events, want 1", got)
+	}
+}
+
+// nilError is an error type whose Error method panics on a nil receiver.
+type nilError struct{ msg string }
+
+func (e *nilError) Error() string { return e.msg }
+
+func TestNilErrors(t *testing.T) {
+	recorder := kslogtest.NewSpanRecorder()
+	var fallback bytes.Buffer
+	tracer := recorder.Tracer("test", kslog.WithFallbackHandler(slog.HandlerOptions{}.NewTextHandler(&fallback)))
+
+	_, span, log := tracer.Start(context.Background(), "errors")
+	var typedNil *nilError
+	log.Error("positional nil", nil)
+	log.Error("keyed nil", slog.Any(kslog.ErrorKey, nil))
+	log.Error("typed nil", attrs.Error(typedNil))
+	span.End()
+
+	recorded := endedSpan(t, recorder)
+	if got := exceptions(recorded); len(got) != 0 {
+		t.Errorf("got %d exception events for nil errors, want none", len(got))
+	}
+	for name, output := range loggedOutputs(t, recorder, &fallback) {
+		if strings.Contains(output, "BADKEY") {
+			t.Errorf("%s output has a BADKEY attribute:\n%s", name, output)
+		}
+	}
+
+	for _, event := range recorded.Events() {
+		v, ok := eventAttributes(event)[kslog.ErrorKey]
+		switch event.Name {
+		case "positional nil":
+			if ok {
+				t.Errorf("event %q has %s=%q, want no error attribute", event.Name, kslog.ErrorKey, v.AsString())
+			}
+		case "keyed nil", "typed nil":
+			if !ok || v.AsString() != "<nil>" {
+				t.Errorf("event %q has %s=%q, want %q", event.Name, kslog.ErrorKey, v.AsString(), "<nil>")
+			}
+		}
+	}
+}
+
+func TestMaxStringLength(t *testing.T) {
+	long := strings.Repeat("é", 20) // 40 bytes
+	for _, tc := range []struct {
+		max  int
+		want string
+	}{
+		{max: 0, want: long},
+		{max: 40, want: long},
+		{max: 31, want: strings.Repeat("é", 8) + kslog.TruncatedMarker},
+		{max: len(kslog.TruncatedMarker), want: kslog.TruncatedMarker},
+		// Too short for the marker; the value is cut without it, and not mid-rune.
+		{max: 5, want: "éé"},
+		{max: 1, want: ""},
+	} {
+		t.Run(fmt.Sprint(tc.max), func(t *testing.T) {
+			recorder := kslogtest.NewSpanRecorder()
+			tracer := recorder.Tracer("test", kslog.WithoutStderr(), kslog.WithMaxStringLength(tc.max))
+
+			_, span, log := tracer.Start(context.Background(), "strings")
+			log.Info("long", slog.String("value", long))
+			span.End()
+
+			got := eventAttributes(endedSpan(t, recorder).Events()[0])["value"].AsString()
+			if got != tc.want {
+				t.Errorf("value is %q, want %q", got, tc.want)
+			}
+			if tc.max > 0 && len(got) > tc.max {
+				t.Errorf("value is %d bytes, over the limit of %d", len(got), tc.max)
+			}
+		})
+	}
+}
+
+// TestWithoutTracerProvider checks logging still works, to stderr only, when no
+// TracerProvider is registered (no test in this package registers one).
+func TestWithoutTracerProvider(t *testing.T) {
+	var stderr bytes.Buffer
+	tracer := kslog.Tracer("test", kslog.WithFallbackHandler(slog.HandlerOptions{}.NewTextHandler(&stderr)))
+
+	ctx, span, log := tracer.Start(context.Background(), "unregistered")
+	if span.IsRecording() {
+		t.Errorf("span is recording without a TracerProvider")
+	}
+	log.Info("hello", slog.String("k", "v"))
+	kslog.FromContext(ctx).Warn("from context")
+	err := errors.New("boom")
+	tracer.Finish(span, log, &err)
+
+	output := stderr.String()
+	for _, want := range []string{"level=INFO msg=hello k=v", "level=WARN msg=\"from context\"", "level=ERROR msg=\"operation failed\"", "error=boom"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("stderr does not contain %q:\n%s", want, output)
+		}
+	}
+	// There is no trace to correlate with.
+	if strings.Contains(output, kslog.TraceIDKey+"=") {
+		t.Errorf("stderr has a trace id without a TracerProvider:\n%s", output)
+	}
+}
+
+// recordingEmitter is a LogEmitter that keeps the records it is given.
+type recordingEmitter struct {
+	mutex   sync.Mutex
+	records []*logspb.LogRecord
+}
+
+func (e *recordingEmitter) Emit(_ context.Context, record *logspb.LogRecord) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.records = append(e.records, record)
+}
+
+func TestSeverityNumber(t *testing.T) {
+	levels := []struct {
+		level slog.Level
+		want  int64
+	}{
+		{level: slog.LevelDebug - 8, want: 1},   // TRACE, clamped
+		{level: slog.LevelDebug, want: 5},       // DEBUG
+		{level: slog.LevelInfo, want: 9},        // INFO
+		{level: slog.LevelInfo + 2, want: 11},   // INFO3
+		{level: slog.LevelWarn, want: 13},       // WARN
+		{level: slog.LevelError, want: 17},      // ERROR
+		{level: slog.LevelError + 20, want: 24}, // FATAL4, clamped
+	}
+	opts := kslog.WithHandlerOptions(slog.HandlerOptions{Level: slog.LevelDebug - 8})
+
+	recorder := kslogtest.NewSpanRecorder()
+	tracer := recorder.Tracer("test", kslog.WithoutStderr(), opts)
+	_, span, log := tracer.Start(context.Background(), "levels")
+	emitter := &recordingEmitter{}
+	logs := slog.New(kslog.NewLogRecordHandler(emitter, kslog.WithoutStderr(), opts))
+	for _, l := range levels {
+		log.Log(context.Background(), l.level, l.level.String())
+		logs.Log(context.Background(), l.level, l.level.String())
+	}
+	span.End()
+
+	events := endedSpan(t, recorder).Events()
+	if len(events) != len(levels) || len(emitter.records) != len(levels) {
+		t.Fatalf("got %d span events and %d log records, want %d of each", len(events), len(emitter.records), len(levels))
+	}
+	for i, l := range levels {
+		attrs := eventAttributes(events[i])
+		if got := attrs["log.severity_number"].AsInt64(); got != l.want {
+			t.Errorf("span event at level %v has log.severity_number %d, want %d", l.level, got, l.want)
+		}
+		// The string level is kept for readability.
+		if got := attrs["log.level"].AsString(); got != l.level.String() {
+			t.Errorf("span event at level %v has log.level %q, want %q", l.level, got, l.level.String())
+		}
+		if got := int64(emitter.records[i].GetSeverityNumber()); got != l.want {
+			t.Errorf("log record at level %v has severity number %d, want %d", l.level, got, l.want)
+		}
+	}
+}
+
+func TestLinkedTraceID(t *testing.T) {
+	const linked = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, tc := range []struct {
+		name    string
+		traceID string
+		// wantSpanAttr is whether the trace id is also set on the span.
+		wantSpanAttr bool
+	}{
+		{name: "valid", traceID: linked, wantSpanAttr: true},
+		{name: "invalid", traceID: "not-a-trace-id", wantSpanAttr: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := kslogtest.NewSpanRecorder()
+			tracer := recorder.Tracer("test", kslog.WithoutStderr())
+
+			_, span, log := tracer.Start(context.Background(), "caller")
+			log.Info("started downstream request", slog.String(kslog.LinkedTraceIDKey, tc.traceID))
+			span.End()
+
+			recorded := endedSpan(t, recorder)
+			if got := eventAttributes(recorded.Events()[0])[kslog.LinkedTraceIDKey].AsString(); got != tc.traceID {
+				t.Errorf("event has %s=%q, want %q", kslog.LinkedTraceIDKey, got, tc.traceID)
+			}
+			var spanAttr string
+			for _, kv := range recorded.Attributes() {
+				if kv.Key == kslog.LinkedTraceIDKey {
+					spanAttr = kv.Value.AsString()
+				}
+			}
+			switch {
+			case tc.wantSpanAttr && spanAttr != tc.traceID:
+				t.Errorf("span has %s=%q, want %q", kslog.LinkedTraceIDKey, spanAttr, tc.traceID)
+			case !tc.wantSpanAttr && spanAttr != "":
+				t.Errorf("span has %s=%q, want none", kslog.LinkedTraceIDKey, spanAttr)
+			}
+		})
+	}
+}
+
+func TestDuplicateKeyPolicy(t *testing.T) {
+	defer kslog.SetDuplicateKeyPolicy(kslog.LastValueWins)
+
+	for _, tc := range []struct {
+		name   string
+		policy kslog.DuplicateKeyPolicy
+		want   []int64
+	}{
+		{name: "last value wins", policy: kslog.LastValueWins, want: []int64{2}},
+		{name: "first value wins", policy: kslog.FirstValueWins, want: []int64{1}},
+		{name: "keep duplicates", policy: kslog.KeepDuplicates, want: []int64{1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kslog.SetDuplicateKeyPolicy(tc.policy)
+			recorder := kslogtest.NewSpanRecorder()
+			tracer := recorder.Tracer("test", kslog.WithoutStderr())
+
+			_, span, log := tracer.Start(context.Background(), "duplicates")
+			log.With("k", 1).Info("duplicate", "k", 2)
+			span.End()
+
+			var got []int64
+			for _, kv := range endedSpan(t, recorder).Events()[0].Attributes {
+				if kv.Key == "k" {
+					got = append(got, kv.Value.AsInt64())
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("event has k=%v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEventName(t *testing.T) {
+	recorder := kslogtest.NewSpanRecorder()
+	tracer := recorder.Tracer("test", kslog.WithoutStderr())
+
+	_, span, log := tracer.Start(context.Background(), "events")
+	log.Info("fetched 1234 bytes from gateway-7", kslog.EventName("gateway.fetched"), slog.Int("bytes", 1234))
+	log.Info("plain message")
+	span.End()
+
+	events := endedSpan(t, recorder).Events()
+	if len(events) != 2 {
+		t.Fatalf("got %d span events, want 2", len(events))
+	}
+
+	named := events[0]
+	if named.Name != "gateway.fetched" {
+		t.Errorf("event is named %q, want %q", named.Name, "gateway.fetched")
+	}
+	attrs := eventAttributes(named)
+	if got := attrs[kslog.MessageKey].AsString(); got != "fetched 1234 bytes from gateway-7" {
+		t.Errorf("event has %s=%q, want the log message", kslog.MessageKey, got)
+	}
+	if _, ok := attrs[kslog.EventNameKey]; ok {
+		t.Errorf("event has a %s attribute; it should only name the event", kslog.EventNameKey)
+	}
+	if got := attrs["bytes"].AsInt64(); got != 1234 {
+		t.Errorf("event has bytes=%d, want 1234", got)
+	}
+
+	// Without the attribute, the event is named with the message.
+	plain := events[1]
+	if plain.Name != "plain message" {
+		t.Errorf("event is named %q, want %q", plain.Name, "plain message")
+	}
+	if _, ok := eventAttributes(plain)[kslog.MessageKey]; ok {
+		t.Errorf("event named with its message also has a %s attribute", kslog.MessageKey)
+	}
+}
+
+func TestKeyMappingRenamesErrors(t *testing.T) {
+	kslog.SetKeyMapping(map[string]string{attrs.ErrorKey: "exception.cause", attrs.ErrorTypeKey: "exception.cause_type"})
+	defer kslog.SetKeyMapping(nil)
+
+	recorder := kslogtest.NewSpanRecorder()
+	tracer := recorder.Tracer("test", kslog.WithoutStderr())
+
+	err := errors.New("connection refused")
+	_, span, log := tracer.Start(context.Background(), "mapping")
+	log.Error("failed", attrs.Error(err), attrs.ErrorType(err))
+	span.End()
+
+	event := endedSpan(t, recorder).Events()[0]
+	got := eventAttributes(event)
+	if v := got["exception.cause"]; v.AsString() != "connection refused" {
+		t.Errorf("event %q has exception.cause %q, want %q", event.Name, v.Emit(), "connection refused")
+	}
+	if v := got["exception.cause_type"]; v.AsString() != "*errors.errorString" {
+		t.Errorf("event %q has exception.cause_type %q, want %q", event.Name, v.Emit(), "*errors.errorString")
+	}
+	for _, key := range []attribute.Key{attrs.ErrorKey, attrs.ErrorTypeKey} {
+		if _, ok := got[key]; ok {
+			t.Errorf("event %q still has the unmapped key %q", event.Name, key)
+		}
+	}
+}
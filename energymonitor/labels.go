@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// metricLabelKeys is the allowlist of context attribute keys that are promoted
+// to metric attributes; set from the -metric-labels flag.
+// Attributes are opt-in because each one multiplies the number of exported series.
+var metricLabelKeys map[attribute.Key]bool
+
+// setMetricLabelKeys parses a comma-separated list of attribute keys into metricLabelKeys.
+func setMetricLabelKeys(s string) {
+	keys := make(map[attribute.Key]bool)
+	for _, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			keys[attribute.Key(key)] = true
+		}
+	}
+	metricLabelKeys = keys
+}
+
+type contextAttributesKey struct{}
+
+// withContextAttributes returns a context carrying kvs in addition to any attributes already on ctx.
+// These are typically also set on the span, so traces and metrics are labeled consistently.
+func withContextAttributes(ctx context.Context, kvs ...attribute.KeyValue) context.Context {
+	existing := contextAttributes(ctx)
+	merged := make([]attribute.KeyValue, 0, len(existing)+len(kvs))
+	merged = append(merged, existing...)
+	merged = append(merged, kvs...)
+	return context.WithValue(ctx, contextAttributesKey{}, merged)
+}
+
+// contextAttributes returns the attributes added to ctx by withContextAttributes.
+func contextAttributes(ctx context.Context) []attribute.KeyValue {
+	kvs, _ := ctx.Value(contextAttributesKey{}).([]attribute.KeyValue)
+	return kvs
+}
+
+// metricAttributes returns the attributes for a metric recorded in ctx:
+// the allowlisted context attributes, followed by extra.
+func metricAttributes(ctx context.Context, extra ...attribute.KeyValue) []attribute.KeyValue {
+	var kvs []attribute.KeyValue
+	for _, kv := range contextAttributes(ctx) {
+		if metricLabelKeys[kv.Key] {
+			kvs = append(kvs, kv)
+		}
+	}
+	return append(kvs, extra...)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,6 +11,10 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/justinsb/experiments-slog/energymonitor/attrs"
@@ -21,10 +26,13 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/contrib/instrumentation/runtime"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/metric/global"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/metric"
@@ -36,72 +44,378 @@ import (
 
 var tracer = kslog.Tracer("energymonitor")
 
+// otlpEndpoints holds the OTLP collector endpoint for each signal.
+type otlpEndpoints struct {
+	Traces  string
+	Metrics string
+	Logs    string
+}
+
+// otlpEndpointsFromEnv resolves the collector endpoints from the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,
+// OTEL_EXPORTER_OTLP_METRICS_ENDPOINT and OTEL_EXPORTER_OTLP_LOGS_ENDPOINT
+// variables, falling back to OTEL_ENDPOINT for compatibility.
+func otlpEndpointsFromEnv() otlpEndpoints {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_ENDPOINT")
+	}
+
+	endpoints := otlpEndpoints{Traces: endpoint, Metrics: endpoint, Logs: endpoint}
+	if s := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); s != "" {
+		endpoints.Traces = s
+	}
+	if s := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"); s != "" {
+		endpoints.Metrics = s
+	}
+	if s := os.Getenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT"); s != "" {
+		endpoints.Logs = s
+	}
+	return endpoints
+}
+
+// grpcTarget converts an OTLP endpoint to a GRPC dial target.
+// The standard variables are URLs (e.g. http://collector:4317), but we also accept a bare host:port.
+func grpcTarget(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint
+	}
+	return u.Host
+}
+
+const (
+	exporterOTLP   = "otlp"
+	exporterStdout = "stdout"
+)
+
+// providerConfig holds the options for initProvider.
+type providerConfig struct {
+	// Exporter is where telemetry is sent: exporterOTLP (the default) or exporterStdout for local debugging.
+	Exporter string
+
+	// ServiceName and ServiceNamespace identify us in the resource attributes.
+	// ServiceNamespace is omitted if empty.
+	ServiceName      string
+	ServiceNamespace string
+
+	Endpoints otlpEndpoints
+	Headers   otlpHeaders
+
+	// PowerHistogramBuckets are the explicit bucket boundaries for the power histograms.
+	PowerHistogramBuckets []float64
+
+	// RuntimeMetrics enables the Go runtime metrics (memory, goroutines, GC).
+	RuntimeMetrics bool
+
+	// DisableTraces skips trace export, leaving only metrics.
+	DisableTraces bool
+
+	// ExportLogs also exports logs as OTLP log records, in addition to span events.
+	ExportLogs bool
+
+	// MetricExportInterval is how often metrics are exported, and MetricExportTimeout
+	// bounds each export, so a slow collector can't hold back the next one indefinitely.
+	MetricExportInterval time.Duration
+	MetricExportTimeout  time.Duration
+
+	// TraceQueueSize is the maximum number of spans buffered for export.
+	TraceQueueSize int
+	// TraceBatchSize is the maximum number of spans in one export.
+	TraceBatchSize int
+}
+
+// otlpHeaders holds the headers sent to the OTLP collector for each signal,
+// typically used for API keys of hosted backends.
+type otlpHeaders struct {
+	Traces  map[string]string
+	Metrics map[string]string
+	Logs    map[string]string
+}
+
+// otlpHeadersFromEnv reads the standard OTEL_EXPORTER_OTLP_HEADERS variable,
+// with OTEL_EXPORTER_OTLP_TRACES_HEADERS, OTEL_EXPORTER_OTLP_METRICS_HEADERS and
+// OTEL_EXPORTER_OTLP_LOGS_HEADERS adding to (or overriding) it for each signal.
+func otlpHeadersFromEnv() (otlpHeaders, error) {
+	common, err := parseOTLPHeaders("OTEL_EXPORTER_OTLP_HEADERS")
+	if err != nil {
+		return otlpHeaders{}, err
+	}
+	traces, err := parseOTLPHeaders("OTEL_EXPORTER_OTLP_TRACES_HEADERS")
+	if err != nil {
+		return otlpHeaders{}, err
+	}
+	metrics, err := parseOTLPHeaders("OTEL_EXPORTER_OTLP_METRICS_HEADERS")
+	if err != nil {
+		return otlpHeaders{}, err
+	}
+	logs, err := parseOTLPHeaders("OTEL_EXPORTER_OTLP_LOGS_HEADERS")
+	if err != nil {
+		return otlpHeaders{}, err
+	}
+
+	headers := otlpHeaders{
+		Traces:  make(map[string]string),
+		Metrics: make(map[string]string),
+		Logs:    make(map[string]string),
+	}
+	for k, v := range common {
+		headers.Traces[k] = v
+		headers.Metrics[k] = v
+		headers.Logs[k] = v
+	}
+	for k, v := range traces {
+		headers.Traces[k] = v
+	}
+	for k, v := range metrics {
+		headers.Metrics[k] = v
+	}
+	for k, v := range logs {
+		headers.Logs[k] = v
+	}
+	return headers, nil
+}
+
+// parseOTLPHeaders parses an environment variable in the OTLP headers format,
+// a comma-separated list of key=value pairs with URL-encoded values.
+func parseOTLPHeaders(envVar string) (map[string]string, error) {
+	headers := make(map[string]string)
+	s := os.Getenv(envVar)
+	if s == "" {
+		return headers, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			// Don't include the value in the error, it is likely a secret.
+			return nil, fmt.Errorf("error parsing %s: expected key=value", envVar)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: invalid value for %q: %w", envVar, k, err)
+		}
+		headers[k] = value
+	}
+	return headers, nil
+}
+
+// headerNames returns the sorted, comma-separated names of headers, omitting the values.
+func headerNames(headers map[string]string) string {
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
 // Initializes an OTLP exporter, and configures the corresponding trace and
 // metric providers.
-func initProvider(otelEndpoint string) (func(), error) {
+// The returned func flushes and shuts down the providers, giving up when ctx is done.
+// With cfg.ExportLogs, the returned handler emits OTLP log records; otherwise it is nil.
+func initProvider(cfg providerConfig) (func(ctx context.Context), slog.Handler, error) {
 	ctx := context.Background()
+	endpoints := cfg.Endpoints
 
-	log := slog.FromContext(ctx)
-
-	log.Info("configuring opentelemetry", slog.String("otel.endpoint", otelEndpoint))
+	log := kslog.FromContext(ctx)
 
+	resourceAttributes := []attribute.KeyValue{
+		semconv.ServiceNameKey.String(cfg.ServiceName),
+	}
+	if cfg.ServiceNamespace != "" {
+		resourceAttributes = append(resourceAttributes, semconv.ServiceNamespaceKey.String(cfg.ServiceNamespace))
+	}
 	res, err := resource.New(ctx,
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String("energymonitor"),
-		),
+		resource.WithAttributes(resourceAttributes...),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create opentelemetry resource: %w", err)
+		return nil, nil, fmt.Errorf("failed to create opentelemetry resource: %w", err)
 	}
 
-	conn, err := grpc.DialContext(ctx, otelEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GRPC connection to opentelemetry collector %q: %w", otelEndpoint, err)
+	sampler := sdktrace.AlwaysSample()
+
+	// Summarize the resolved configuration in one line, to help debug missing telemetry.
+	// Header values are typically API keys, so only the names are logged.
+	configAttrs := []slog.Attr{
+		slog.String("otel.exporter", cfg.Exporter),
+		slog.String("otel.resource", res.String()),
+		slog.Bool("otel.traces.enabled", !cfg.DisableTraces),
+		slog.Bool("otel.logs.enabled", cfg.ExportLogs),
+	}
+	if !cfg.DisableTraces {
+		configAttrs = append(configAttrs,
+			slog.String("otel.traces.sampler", sampler.Description()),
+			slog.Int("otel.traces.queue_size", cfg.TraceQueueSize),
+			slog.Int("otel.traces.batch_size", cfg.TraceBatchSize),
+		)
+	}
+	configAttrs = append(configAttrs,
+		slog.Duration("otel.metrics.export_interval", cfg.MetricExportInterval),
+		slog.Duration("otel.metrics.export_timeout", cfg.MetricExportTimeout),
+	)
+	if cfg.Exporter == exporterOTLP {
+		configAttrs = append(configAttrs,
+			slog.String("otel.protocol", "grpc"),
+			slog.Bool("otel.tls", false),
+			slog.String("otel.traces.endpoint", endpoints.Traces),
+			slog.String("otel.traces.headers", headerNames(cfg.Headers.Traces)),
+			slog.String("otel.metrics.endpoint", endpoints.Metrics),
+			slog.String("otel.metrics.headers", headerNames(cfg.Headers.Metrics)),
+		)
+		if cfg.ExportLogs {
+			configAttrs = append(configAttrs,
+				slog.String("otel.logs.endpoint", endpoints.Logs),
+				slog.String("otel.logs.headers", headerNames(cfg.Headers.Logs)),
+			)
+		}
+	}
+	configAttrs = append(configAttrs, slog.Bool("otel.runtime_metrics", cfg.RuntimeMetrics))
+	log.LogAttrs(ctx, slog.LevelInfo, "configuring opentelemetry", configAttrs...)
+
+	// Signals sent to the same endpoint share a connection.
+	conns := make(map[string]*grpc.ClientConn)
+	dial := func(endpoint string) (*grpc.ClientConn, error) {
+		if conn := conns[endpoint]; conn != nil {
+			return conn, nil
+		}
+		conn, err := grpc.DialContext(ctx, grpcTarget(endpoint), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GRPC connection to opentelemetry collector %q: %w", endpoint, err)
+		}
+		conns[endpoint] = conn
+		return conn, nil
 	}
 
-	// Set up a trace exporter
-	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create opentelemetry trace exporter: %w", err)
+	var tracerProvider *sdktrace.TracerProvider
+	if cfg.DisableTraces {
+		// Spans are non-recording; LogTracer still logs to stderr.
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	} else {
+		// Set up a trace exporter
+		var traceExporter sdktrace.SpanExporter
+		if cfg.Exporter == exporterStdout {
+			traceExporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+		} else {
+			var traceConn *grpc.ClientConn
+			traceConn, err = dial(endpoints.Traces)
+			if err != nil {
+				return nil, nil, err
+			}
+			traceExporter, err = otlptracegrpc.New(ctx,
+				otlptracegrpc.WithGRPCConn(traceConn),
+				otlptracegrpc.WithHeaders(cfg.Headers.Traces),
+			)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create opentelemetry trace exporter: %w", err)
+		}
+
+		// Register the trace exporter with a TracerProvider, using a batch
+		// span processor to aggregate spans before export.
+		// If the queue fills (e.g. the collector is slow), new spans are dropped;
+		// droppedSpansExporter counts them, and spans whose export fails.
+		exporter := &droppedSpansExporter{SpanExporter: traceExporter}
+		bsp := sdktrace.NewBatchSpanProcessor(exporter,
+			sdktrace.WithMaxQueueSize(cfg.TraceQueueSize),
+			sdktrace.WithMaxExportBatchSize(cfg.TraceBatchSize),
+		)
+		tracerProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sampler),
+			sdktrace.WithResource(res),
+			sdktrace.WithSpanProcessor(exporter.Processor(bsp)),
+		)
+		otel.SetTracerProvider(tracerProvider)
 	}
 
-	// Register the trace exporter with a TracerProvider, using a batch
-	// span processor to aggregate spans before export.
-	bsp := sdktrace.NewBatchSpanProcessor(traceExporter)
-	tracerProvider := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
-	)
-	otel.SetTracerProvider(tracerProvider)
+	// Report export failures, which otherwise only go to the standard logger.
+	// The default logger is looked up each time, as it changes with -export-logs.
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Default().Warn("opentelemetry error", attrs.Error(err))
+	}))
 
 	// set global propagator to tracecontext (the default is no-op).
 	otel.SetTextMapPropagator(propagation.TraceContext{})
 
-	metricExporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithGRPCConn(conn))
+	var metricExporter metric.Exporter
+	if cfg.Exporter == exporterStdout {
+		metricExporter, err = stdoutmetric.New()
+	} else {
+		var metricConn *grpc.ClientConn
+		metricConn, err = dial(endpoints.Metrics)
+		if err != nil {
+			return nil, nil, err
+		}
+		metricExporter, err = otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithGRPCConn(metricConn),
+			otlpmetricgrpc.WithHeaders(cfg.Headers.Metrics),
+		)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error creating opentelemetry metric exporter: %w", err)
+		return nil, nil, fmt.Errorf("error creating opentelemetry metric exporter: %w", err)
 	}
 
-	metricReader := metric.NewPeriodicReader(metricExporter)
+	views, err := powerHistogramViews(cfg.PowerHistogramBuckets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metricReader := metric.NewPeriodicReader(metricExporter,
+		metric.WithInterval(cfg.MetricExportInterval),
+		metric.WithTimeout(cfg.MetricExportTimeout),
+	)
 	meterProvider := metric.NewMeterProvider(
 		metric.WithResource(res),
-		metric.WithReader(metricReader),
+		metric.WithReader(metricReader, views...),
 	)
 	global.SetMeterProvider(meterProvider)
 
-	return func() {
-		if err := meterProvider.Shutdown(context.Background()); err != nil {
-			log.Error("failed to shutdown opentelemetry metric provider", err)
+	if cfg.RuntimeMetrics {
+		if err := runtime.Start(runtime.WithMeterProvider(meterProvider)); err != nil {
+			return nil, nil, fmt.Errorf("failed to start runtime metrics: %w", err)
 		}
-		if err := tracerProvider.Shutdown(context.Background()); err != nil {
-			log.Error("failed to shutdown opentelemetry tracer provider", err)
+	}
+
+	var logExporter *kslog.OTLPLogExporter
+	var logHandler slog.Handler
+	if cfg.ExportLogs {
+		if cfg.Exporter == exporterStdout {
+			// Log records are already echoed to stderr.
+			log.Warn("log records are not exported with the stdout exporter")
+		} else {
+			logConn, err := dial(endpoints.Logs)
+			if err != nil {
+				return nil, nil, err
+			}
+			logExporter = kslog.NewOTLPLogExporter(logConn, res, cfg.Headers.Logs)
+			logHandler = kslog.NewLogRecordHandler(logExporter)
+		}
+	}
+
+	return func(ctx context.Context) {
+		log := slog.Default()
+		if err := meterProvider.Shutdown(ctx); err != nil {
+			log.Error("failed to shutdown opentelemetry metric provider", attrs.Error(err))
 		}
-	}, nil
+		if tracerProvider != nil {
+			if err := tracerProvider.Shutdown(ctx); err != nil {
+				log.Error("failed to shutdown opentelemetry tracer provider", attrs.Error(err))
+			}
+		}
+		// Last, so it includes any errors logged by the other providers' shutdown.
+		if logExporter != nil {
+			if err := logExporter.Shutdown(ctx); err != nil {
+				log.Error("failed to shutdown opentelemetry log exporter", attrs.Error(err))
+			}
+		}
+		if ctx.Err() != nil {
+			log.Warn("opentelemetry shutdown did not complete before the deadline; some telemetry may not have been exported")
+		}
+	}, logHandler, nil
 }
 
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	if err := run(ctx); err != nil {
@@ -120,14 +434,168 @@ func installHooks() error {
 }
 
 func run(ctx context.Context) error {
+	startTime = time.Now()
+
 	kslog.InitFlags(nil)
+	flag.Var(&powerInstruments, "power-instruments", "instruments used to report power readings: gauge, histogram or both")
+	recordMissingAsZero := false
+	flag.BoolVar(&recordMissingAsZero, "record-missing-as-zero", recordMissingAsZero, "record zero when a measurement is missing from the gateway response, rather than keeping the last value")
+	httpListen := ""
+	flag.StringVar(&httpListen, "http-listen", httpListen, "if set, address on which to serve the latest readings in OpenMetrics format (/metrics) and as Server-Sent Events (/events), and readiness (/readyz)")
+	// -openmetrics-listen was the name of -http-listen before it also served events and readiness.
+	flag.StringVar(&httpListen, "openmetrics-listen", httpListen, "deprecated: use -http-listen")
+	readiness.Mode = readinessFirstRead
+	flag.StringVar(&readiness.Mode, "readiness", readiness.Mode, "what /readyz checks: first-read (a reading has been recorded), recent (a reading within -readiness-max-age) or probe (a HEAD request to the gateway succeeds)")
+	readiness.MaxAge = 5 * time.Minute
+	flag.DurationVar(&readiness.MaxAge, "readiness-max-age", readiness.MaxAge, "with -readiness=recent, how recent the last reading must be")
+	readiness.ProbeInterval = 30 * time.Second
+	flag.DurationVar(&readiness.ProbeInterval, "readiness-probe-interval", readiness.ProbeInterval, "with -readiness=probe, how long a probe result is reused before probing the gateway again")
+	replayDir := ""
+	flag.StringVar(&replayDir, "replay-dir", replayDir, "if set, replay the production.json captures in this directory instead of reading from the gateway")
+	flag.DurationVar(&clockSkewThreshold, "clock-skew-threshold", clockSkewThreshold, "warn when the gateway's reading time differs from our clock by more than this; 0 to disable the warning")
+	replayInterval := time.Second
+	flag.DurationVar(&replayInterval, "replay-interval", replayInterval, "interval between replayed captures")
+	powerHistogramBuckets := BucketsFlag(defaultPowerHistogramBuckets)
+	flag.Var(&powerHistogramBuckets, "power-histogram-buckets", "comma-separated bucket boundaries (in watts) for the power histograms")
+	flag.BoolVar(&debugMetricCallbacks, "debug-metric-callbacks", debugMetricCallbacks, "log (and trace) each time the gauge callback reports values")
+	flag.StringVar(&metricPrefix, "metric-prefix", metricPrefix, "prefix for all metric names, e.g. energymonitor_ (recommended when sharing a backend with other exporters)")
+	flag.BoolVar(&lifetimeCounters, "lifetime-counters", lifetimeCounters, "also export the gateway's lifetime watt-hours as monotonic counters")
+	runtimeMetrics := false
+	flag.BoolVar(&runtimeMetrics, "runtime-metrics", runtimeMetrics, "also export Go runtime metrics (memory, goroutines, GC)")
+	attributeKeys := "legacy"
+	flag.StringVar(&attributeKeys, "attribute-keys", attributeKeys, "semantic conventions for emitted log attribute keys: legacy or stable")
+	disableTraces := false
+	flag.BoolVar(&disableTraces, "disable-traces", disableTraces, "only export metrics; spans are not recorded, and logs only go to stderr")
+	exportLogs := false
+	flag.BoolVar(&exportLogs, "export-logs", exportLogs, "also export logs as OTLP log records, including those logged outside any span")
+	traceQueueSize := sdktrace.DefaultMaxQueueSize
+	flag.IntVar(&traceQueueSize, "trace-queue-size", traceQueueSize, "maximum number of spans buffered for export; further spans are dropped")
+	traceBatchSize := sdktrace.DefaultMaxExportBatchSize
+	flag.IntVar(&traceBatchSize, "trace-batch-size", traceBatchSize, "maximum number of spans sent in one export")
+	metricExportInterval := time.Minute
+	flag.DurationVar(&metricExportInterval, "metric-export-interval", metricExportInterval, "interval between metric exports")
+	metricExportTimeout := 30 * time.Second
+	flag.DurationVar(&metricExportTimeout, "metric-export-timeout", metricExportTimeout, "maximum time for one metric export; a slower export is abandoned")
+	metricLabels := ""
+	flag.StringVar(&metricLabels, "metric-labels", metricLabels, "comma-separated span attribute keys (e.g. reader) to also apply as metric attributes")
+	serviceName := "energymonitor"
+	if s := os.Getenv("OTEL_SERVICE_NAME"); s != "" {
+		serviceName = s
+	}
+	flag.StringVar(&serviceName, "service-name", serviceName, "service name reported to opentelemetry (defaults to OTEL_SERVICE_NAME if set)")
+	serviceNamespace := ""
+	flag.StringVar(&serviceNamespace, "service-namespace", serviceNamespace, "if set, service namespace reported to opentelemetry, e.g. to distinguish sites or environments")
+	source := sourceHTTP
+	flag.StringVar(&source, "source", source, "where readings come from: http (poll the gateway at BASE_URL) or mqtt (subscribe to -mqtt-topic)")
+	mqttCfg := mqttConfig{
+		ClientID: mqttClientID(),
+		Username: os.Getenv("MQTT_USERNAME"),
+		Password: os.Getenv("MQTT_PASSWORD"),
+	}
+	flag.StringVar(&mqttCfg.Broker, "mqtt-broker", "tcp://localhost:1883", "mqtt broker URL, with -source=mqtt")
+	flag.StringVar(&mqttCfg.Topic, "mqtt-topic", "energymonitor/readings", "mqtt topic on which readings are published, with -source=mqtt")
+	flag.StringVar(&mqttCfg.ClientID, "mqtt-client-id", mqttCfg.ClientID, "mqtt client id, with -source=mqtt")
+	shutdownTimeout := 10 * time.Second
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "maximum time to spend flushing telemetry on exit")
+	sampleRequest := ""
+	flag.StringVar(&sampleRequest, "sample-request", sampleRequest, "if set, fetch production.json from the gateway once, write the raw response to this file, and exit")
 	flag.Parse()
 
-	shutdown, err := initProvider(os.Getenv("OTEL_ENDPOINT"))
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "openmetrics-listen" {
+			slog.Warn("-openmetrics-listen is deprecated, use -http-listen")
+		}
+	})
+
+	setMetricLabelKeys(metricLabels)
+
+	switch readiness.Mode {
+	case readinessFirstRead, readinessRecent, readinessProbe:
+	default:
+		return fmt.Errorf("unknown -readiness value %q (must be first-read, recent or probe)", readiness.Mode)
+	}
+
+	switch source {
+	case sourceHTTP, sourceMQTT:
+	default:
+		return fmt.Errorf("unknown -source value %q (must be http or mqtt)", source)
+	}
+	if source == sourceMQTT && readiness.Mode == readinessProbe {
+		// The probe sends HEAD to the gateway at BASE_URL, which isn't used (or may be unrelated) with mqtt.
+		return fmt.Errorf("-readiness=probe requires -source=http")
+	}
+
+	switch attributeKeys {
+	case "legacy":
+	case "stable":
+		kslog.SetKeyMapping(attrs.StableHTTPKeys)
+	default:
+		return fmt.Errorf("unknown -attribute-keys value %q", attributeKeys)
+	}
+
+	if sampleRequest != "" {
+		// No telemetry is needed for a one-off capture, so skip connecting to the collector;
+		// the metrics are still created, against the (no-op) global meter.
+		if err := InitMetrics(global.Meter("justinsb.com/energy")); err != nil {
+			return fmt.Errorf("failed to initialize metrics: %w", err)
+		}
+		reader, err := NewMeterReader()
+		if err != nil {
+			return fmt.Errorf("error from NewMeterReader: %w", err)
+		}
+		return sampleProduction(ctx, reader, sampleRequest)
+	}
+
+	headers, err := otlpHeadersFromEnv()
+	if err != nil {
+		return err
+	}
+
+	exporter := os.Getenv("OTEL_EXPORTER")
+	switch exporter {
+	case "":
+		exporter = exporterOTLP
+	case exporterOTLP, exporterStdout:
+	default:
+		return fmt.Errorf("unknown OTEL_EXPORTER=%q (must be otlp or stdout)", exporter)
+	}
+
+	shutdown, logHandler, err := initProvider(providerConfig{
+		Exporter:              exporter,
+		ServiceName:           serviceName,
+		ServiceNamespace:      serviceNamespace,
+		Endpoints:             otlpEndpointsFromEnv(),
+		Headers:               headers,
+		PowerHistogramBuckets: powerHistogramBuckets,
+		RuntimeMetrics:        runtimeMetrics,
+		DisableTraces:         disableTraces,
+		ExportLogs:            exportLogs,
+		MetricExportInterval:  metricExportInterval,
+		MetricExportTimeout:   metricExportTimeout,
+		TraceQueueSize:        traceQueueSize,
+		TraceBatchSize:        traceBatchSize,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to initialize otel provider: %w", err)
 	}
-	defer shutdown()
+	defer func() {
+		// A fresh context, since ctx is typically already cancelled; bounded so an
+		// unreachable collector can't stop us exiting.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		shutdown(ctx)
+	}()
+
+	if logHandler != nil {
+		// Span loggers forward to the logger on the context, so their logs are exported too.
+		// The default logger is a separate Logger, as the default is not forwarded to.
+		ctx = kslog.NewContext(ctx, slog.New(logHandler))
+		slog.SetDefault(slog.New(logHandler))
+	}
+
+	if err := InitMetrics(global.Meter("justinsb.com/energy")); err != nil {
+		return fmt.Errorf("failed to initialize metrics: %w", err)
+	}
 
 	if err := installHooks(); err != nil {
 		return err
@@ -137,32 +605,67 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error from NewMeterReader: %w", err)
 	}
+	reader.RecordMissingAsZero = recordMissingAsZero
+	readiness.Probe = reader.Probe
+
+	if httpListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", &openMetricsHandler{})
+		mux.Handle("/events", &eventsHandler{})
+		mux.Handle("/readyz", &readiness)
+		server := &http.Server{Addr: httpListen, Handler: mux}
+		go func() {
+			slog.Info("serving http", slog.String("listen", httpListen))
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("error serving http", attrs.Error(err))
+			}
+		}()
+		defer server.Close()
+	}
 
-	readMeterForever(ctx, reader)
+	if replayDir != "" {
+		recordClockSkew = false
+		return replayProduction(ctx, realClock{}, reader, replayDir, replayInterval)
+	}
+
+	if source == sourceMQTT {
+		return readMQTTForever(ctx, mqttCfg)
+	}
+
+	readMeterForever(ctx, realClock{}, reader)
 
 	return nil
 }
 
-func readMeterForever(ctx context.Context, reader *MeterReader) error {
+func readMeterForever(ctx context.Context, clock Clock, reader *MeterReader) error {
 	interval := 1 * time.Minute
-	ticker := time.NewTicker(time.Second)
+	ticker := clock.NewTicker(time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-ticker.C:
+		case <-ticker.C():
+			// select picks randomly if we are also shutting down; don't start an empty span.
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			ticker.Reset(interval)
 			if err := readMeterOnce(ctx, reader); err != nil {
-				slog.Error("error reading meter", err)
+				var authErr *AuthError
+				if errors.As(err, &authErr) {
+					slog.Error("gateway rejected our credentials", attrs.Error(err))
+				} else {
+					slog.Error("error reading meter", attrs.Error(err), attrs.ErrorType(err))
+				}
 			}
 		}
 	}
 }
 
 func readMeterOnce(ctx context.Context, reader *MeterReader) error {
-	readerID := "todo"
+	readerID := reader.ID()
 
 	ctx, span, _ := tracer.Start(ctx, "MeterReader-Read", trace.WithAttributes(attribute.String("reader", readerID)))
 	defer span.End()
@@ -189,8 +692,87 @@ type Measurement struct {
 	WattHoursLifetime float64 `json:"whLifetime"`
 }
 
+// readingTime returns when the gateway took the measurement, or the zero time if it didn't say.
+func (m *Measurement) readingTime() time.Time {
+	if m.ReadingTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(m.ReadingTime, 0)
+}
+
+// UnmarshalJSON accepts the power values and reading time either as JSON numbers or as
+// strings (e.g. "1234.5"), as some gateway firmware versions encode them.
+// An empty string, like an absent value, is zero.
+func (m *Measurement) UnmarshalJSON(b []byte) error {
+	type plain Measurement
+	var raw struct {
+		plain
+		// These shadow the fields in plain.
+		ReadingTime       lenientNumber `json:"readingTime"`
+		WattsNow          lenientNumber `json:"wNow"`
+		WattHoursLifetime lenientNumber `json:"whLifetime"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*m = Measurement(raw.plain)
+	var err error
+	if m.ReadingTime, err = raw.ReadingTime.Int64(); err != nil {
+		return fmt.Errorf("invalid readingTime: %w", err)
+	}
+	if m.WattsNow, err = raw.WattsNow.Float64(); err != nil {
+		return fmt.Errorf("invalid wNow: %w", err)
+	}
+	if m.WattHoursLifetime, err = raw.WattHoursLifetime.Float64(); err != nil {
+		return fmt.Errorf("invalid whLifetime: %w", err)
+	}
+	return nil
+}
+
+// lenientNumber is the text of a number encoded either as a JSON number or as a string.
+// Unlike json.Number, it accepts an empty string; it is empty if the value is absent (or null).
+type lenientNumber string
+
+func (n *lenientNumber) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*n = ""
+		return nil
+	}
+	if len(b) != 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*n = lenientNumber(strings.TrimSpace(s))
+		return nil
+	}
+	*n = lenientNumber(b)
+	return nil
+}
+
+// Float64 parses n, treating an empty value as zero.
+func (n lenientNumber) Float64() (float64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(string(n), 64)
+}
+
+// Int64 parses n as an integer, treating an empty value as zero.
+func (n lenientNumber) Int64() (int64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(n), 10, 64)
+}
+
 type MeterReader struct {
-	baseURL url.URL
+	baseURL    url.URL
+	httpClient *http.Client
+
+	// RecordMissingAsZero records a zero reading when a measurement is absent from the response.
+	RecordMissingAsZero bool
 }
 
 func NewMeterReader() (*MeterReader, error) {
@@ -199,43 +781,205 @@ func NewMeterReader() (*MeterReader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing BASE_URL=%q: %w", baseURL, err)
 	}
-	return &MeterReader{baseURL: *u}, nil
+
+	transport, err := newMeterTransport()
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{
+		Transport: otelhttp.NewTransport(transport),
+	}
+
+	return &MeterReader{baseURL: *u, httpClient: httpClient}, nil
 }
 
-func (r *MeterReader) ReadProduction(ctx context.Context) error {
-	httpClient := http.DefaultClient
+// newMeterTransport builds the transport used to poll the gateway.
+// We poll the same host repeatedly, so we keep connections alive between polls;
+// the idle timeout should be longer than the poll interval.
+// The settings can be overridden with HTTP_MAX_IDLE_CONNS_PER_HOST and HTTP_IDLE_CONN_TIMEOUT.
+func newMeterTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 2
+	transport.IdleConnTimeout = 5 * time.Minute
+
+	if s := os.Getenv("HTTP_MAX_IDLE_CONNS_PER_HOST"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing HTTP_MAX_IDLE_CONNS_PER_HOST=%q: %w", s, err)
+		}
+		transport.MaxIdleConnsPerHost = n
+	}
 
-	ctx, span, log := tracer.Start(ctx, "ReadProduction")
-	defer span.End()
+	if s := os.Getenv("HTTP_IDLE_CONN_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing HTTP_IDLE_CONN_TIMEOUT=%q: %w", s, err)
+		}
+		transport.IdleConnTimeout = d
+	}
+
+	return transport, nil
+}
+
+// ID identifies the reader, for distinguishing multiple readers in telemetry.
+func (r *MeterReader) ID() string {
+	return r.baseURL.Host
+}
+
+func (r *MeterReader) ReadProduction(ctx context.Context) (err error) {
+	// The span name stays low-cardinality; the reader is identified by attribute.
+	// The same attributes are carried on the context, to label metrics (see -metric-labels).
+	kvs := []attribute.KeyValue{attribute.String("reader", r.ID())}
+	ctx = withContextAttributes(ctx, kvs...)
+	ctx, span, log := tracer.Start(ctx, "ReadProduction", trace.WithAttributes(kvs...))
+	defer tracer.Finish(span, log, &err)
+
+	productionURL, b, t, err := r.fetchProduction(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.processProduction(ctx, productionURL, b, t)
+}
+
+// fetchProduction fetches the raw production.json payload from the gateway,
+// returning the URL it was fetched from and when it was fetched.
+// The span and logger are taken from ctx.
+func (r *MeterReader) fetchProduction(ctx context.Context) (string, []byte, time.Time, error) {
+	httpClient := r.httpClient
+	span := trace.SpanFromContext(ctx)
+	log := kslog.FromContext(ctx)
 
 	u := r.baseURL.JoinPath("production.json")
 	u.RawQuery = "details=1"
 	productionURL := u.String()
-	log.Info("doing http request", attrs.HTTPMethod("GET"), attrs.HTTPURL(productionURL))
+	route := endpointRoute(u)
+	span.SetAttributes(attribute.String("http.route", route))
+	log.Info("doing http request", attrs.HTTPMethod("GET"), attrs.HTTPURL(productionURL), attrs.NetPeerName(u.Hostname()), attrs.NetPeerPort(peerPort(u)))
 	t := time.Now()
 	request, err := http.NewRequestWithContext(ctx, "GET", productionURL, nil)
 	if err != nil {
-		return fmt.Errorf("error build HTTP request for %q: %w", productionURL, err)
+		return "", nil, t, fmt.Errorf("error build HTTP request for %q: %w", productionURL, err)
 	}
 	response, err := httpClient.Do(request)
+	elapsed := time.Since(t)
+	recordRequestDuration(ctx, route, elapsed)
 	if err != nil {
-		return fmt.Errorf("error doing HTTP GET %q: %w", productionURL, err)
+		return "", nil, t, &DialError{URL: productionURL, Err: err}
+	}
+	// The body must be closed (and fully read) for the connection to be reused.
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		authFailures.Add(ctx, 1, metricAttributes(ctx)...)
+		return "", nil, t, &AuthError{URL: productionURL, StatusCode: response.StatusCode, Status: response.Status}
 	}
 	if response.StatusCode != 200 {
-		return fmt.Errorf("unexpected result %d from HTTP GET %q: %s", response.StatusCode, productionURL, response.Status)
+		return "", nil, t, &BadStatusError{URL: productionURL, Code: response.StatusCode, Status: response.Status}
 	}
-	b, err := io.ReadAll(response.Body)
+	b, err := readResponseBody(productionURL, response.Body, maxResponseBytes)
 	if err != nil {
-		return fmt.Errorf("error reading response to HTTP GET %q: %w", productionURL, err)
+		return "", nil, t, err
 	}
+	log.Info("got http response", attrs.HTTPStatusCode(response.StatusCode), attrs.HTTPResponseSize(int64(len(b))), attrs.Duration("http.duration", elapsed))
+
+	return productionURL, b, t, nil
+}
+
+// Probe checks the gateway is reachable with a HEAD request, which is much cheaper for
+// the gateway than building production.json. Any HTTP response other than a 5xx counts,
+// except that rejected credentials are reported.
+func (r *MeterReader) Probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	u := r.baseURL.JoinPath("production.json")
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("error build HTTP request for %q: %w", u, err)
+	}
+	response, err := r.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error doing HTTP HEAD %q: %w", u, err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return &AuthError{URL: u.String(), StatusCode: response.StatusCode, Status: response.Status}
+	}
+	if response.StatusCode >= 500 {
+		return fmt.Errorf("unexpected result %d from HTTP HEAD %q: %s", response.StatusCode, u, response.Status)
+	}
+	return nil
+}
+
+// maxResponseBytes caps how much of a gateway response we read; production.json is normally a few KB.
+const maxResponseBytes = 1 << 20
+
+// readResponseBody reads the whole body fetched from u, returning a ResponseTooLargeError if it is longer than limit.
+// Some gateways send no Content-Length (or chunk oddly), so we don't rely on it: we read until EOF,
+// stopping one byte past the limit.
+func readResponseBody(u string, body io.Reader, limit int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, &DialError{URL: u, Err: fmt.Errorf("error reading response: %w", err)}
+	}
+	if int64(len(b)) > limit {
+		return nil, &ResponseTooLargeError{URL: u, Limit: limit}
+	}
+	return b, nil
+}
+
+// peerPort returns the port of u, or the default port for its scheme.
+func peerPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// endpointRoute returns a low-cardinality name for the gateway endpoint at u,
+// suitable for use as a metric attribute: the path only, without query string or host.
+func endpointRoute(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// parseProduction parses a production.json payload, in its own span so parse time
+// can be told apart from time spent waiting for the gateway.
+func parseProduction(ctx context.Context, source string, b []byte) (*ProductionInfo, error) {
+	_, span, _ := tracer.Start(ctx, "ParseProduction", trace.WithAttributes(attribute.Int("bytes", len(b))))
+	defer span.End()
 
 	var info ProductionInfo
 	if err := json.Unmarshal(b, &info); err != nil {
-		return fmt.Errorf("error parsing %q data: %w", productionURL, err)
+		err = &ParseError{URL: source, Err: err}
+		span.RecordError(err)
+		return nil, err
+	}
+	return &info, nil
+}
+
+// processProduction parses a production.json payload and records the readings it contains.
+// source identifies where the payload came from (for errors), and t is when it was fetched.
+// The span and logger are taken from ctx.
+func (r *MeterReader) processProduction(ctx context.Context, source string, b []byte, t time.Time) error {
+	span := trace.SpanFromContext(ctx)
+	log := kslog.FromContext(ctx)
+
+	info, err := parseProduction(ctx, source, b)
+	if err != nil {
+		return err
 	}
 
 	log.Debug("http response", slog.String("body", string(b)))
 
+	productionCount := 0
 	for _, m := range info.Production {
 		if m.Type != "eim" {
 			continue
@@ -243,14 +987,11 @@ func (r *MeterReader) ReadProduction(ctx context.Context) error {
 		if m.MeasurementType != "production" {
 			continue
 		}
-		log.Info("read production", slog.Int64("time", t.UnixNano()), slog.Float64("watts", m.WattsNow))
-
-		productionSync.Record(ctx, m.WattsNow)
-		production.Observe(ctx, m.WattsNow)
-
-		span.AddEvent("observed production", trace.WithAttributes(attribute.Float64("value", m.WattsNow)))
+		productionCount++
+		recordReading(ctx, Reading{Kind: ReadingKindProduction, Watts: m.WattsNow, WattHoursLifetime: m.WattHoursLifetime, ReadingTime: m.readingTime(), FetchTime: t})
 	}
 
+	consumptionCount := 0
 	for _, m := range info.Consumption {
 		if m.Type != "eim" {
 			continue
@@ -258,10 +999,24 @@ func (r *MeterReader) ReadProduction(ctx context.Context) error {
 		if m.MeasurementType != "total-consumption" {
 			continue
 		}
-		log.Info("read consumption", slog.Int64("time", t.UnixNano()), slog.Float64("watts", m.WattsNow))
-		consumptionSync.Record(ctx, m.WattsNow)
-		consumption.Observe(ctx, m.WattsNow)
-		span.AddEvent("observed consumption", trace.WithAttributes(attribute.Float64("value", m.WattsNow)))
+		consumptionCount++
+		recordReading(ctx, Reading{Kind: ReadingKindConsumption, Watts: m.WattsNow, WattHoursLifetime: m.WattHoursLifetime, ReadingTime: m.readingTime(), FetchTime: t})
+	}
+
+	// A sudden drop to zero matching measurements is an early sign of gateway problems.
+	log.Debug("processed measurements", slog.Int("production", productionCount), slog.Int("consumption", consumptionCount))
+	span.SetAttributes(attribute.Int("measurements.production", productionCount), attribute.Int("measurements.consumption", consumptionCount))
+
+	// Otherwise the gauges would keep reporting the last value we saw.
+	if r.RecordMissingAsZero {
+		if productionCount == 0 {
+			log.Warn("production missing from response, recording zero")
+			recordProduction(ctx, 0)
+		}
+		if consumptionCount == 0 {
+			log.Warn("consumption missing from response, recording zero")
+			recordConsumption(ctx, 0)
+		}
 	}
 
 	return nil
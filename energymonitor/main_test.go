@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/justinsb/experiments-slog/energymonitor/kslog/kslogtest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spans records the spans of every test; the global tracer delegates to the
+// first provider registered, so it is set up once, in TestMain.
+// Tests pick out their own spans by trace ID.
+var spans *kslogtest.SpanRecorder
+
+// metricReader collects the metrics registered by InitMetrics.
+var metricReader metric.Reader
+
+func TestMain(m *testing.M) {
+	spans = kslogtest.NewSpanRecorder()
+	otel.SetTracerProvider(spans.Provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	metricReader = metric.NewManualReader()
+	meterProvider := metric.NewMeterProvider(metric.WithReader(metricReader))
+	if err := InitMetrics(meterProvider.Meter("justinsb.com/energy")); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// productionJSON is a production.json payload with one production measurement.
+const productionJSON = `{"production":[{"type":"eim","measurementType":"production","readingTime":1700000000,"wNow":1234.5}],"consumption":[]}`
+
+// newTestGateway starts a gateway serving productionJSON, calling onRequest with each request first.
+func newTestGateway(t *testing.T, onRequest func(r *http.Request)) *MeterReader {
+	t.Helper()
+
+	return newTestGatewayHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if onRequest != nil {
+			onRequest(r)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(productionJSON))
+	})
+}
+
+// newTestGatewayHandler starts a gateway serving production.json with handler,
+// and returns a MeterReader for it.
+func newTestGatewayHandler(t *testing.T, handler http.HandlerFunc) *MeterReader {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/production.json" {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("BASE_URL", server.URL)
+	reader, err := NewMeterReader()
+	if err != nil {
+		t.Fatalf("NewMeterReader failed: %v", err)
+	}
+	return reader
+}
+
+// spansInTrace returns the ended spans of the given trace.
+func spansInTrace(traceID trace.TraceID) []sdktrace.ReadOnlySpan {
+	var matches []sdktrace.ReadOnlySpan
+	for _, span := range spans.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			matches = append(matches, span)
+		}
+	}
+	return matches
+}
+
+// findSpan returns the span with the given name, failing the test if there isn't exactly one.
+func findSpan(t *testing.T, spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	var found sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() != name {
+			continue
+		}
+		if found != nil {
+			t.Fatalf("found more than one %q span", name)
+		}
+		found = span
+	}
+	if found == nil {
+		t.Fatalf("no %q span found", name)
+	}
+	return found
+}
+
+func TestReadProductionPropagatesTraceContext(t *testing.T) {
+	var mutex sync.Mutex
+	var traceparent string
+	reader := newTestGateway(t, func(r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		traceparent = r.Header.Get("traceparent")
+	})
+
+	if err := reader.ReadProduction(context.Background()); err != nil {
+		t.Fatalf("ReadProduction failed: %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// version-traceid-spanid-flags
+	fields := strings.Split(traceparent, "-")
+	if len(fields) != 4 {
+		t.Fatalf("gateway got traceparent %q, want version-traceid-spanid-flags", traceparent)
+	}
+	traceID, err := trace.TraceIDFromHex(fields[1])
+	if err != nil {
+		t.Fatalf("invalid trace id in traceparent %q: %v", traceparent, err)
+	}
+	spanID, err := trace.SpanIDFromHex(fields[2])
+	if err != nil {
+		t.Fatalf("invalid span id in traceparent %q: %v", traceparent, err)
+	}
+
+	inTrace := spansInTrace(traceID)
+	readProduction := findSpan(t, inTrace, "ReadProduction")
+
+	// The request is made by the otelhttp transport, so the propagated span is its client span,
+	// which must be a child of ReadProduction.
+	var client sdktrace.ReadOnlySpan
+	for _, span := range inTrace {
+		if span.SpanContext().SpanID() == spanID {
+			client = span
+		}
+	}
+	if client == nil {
+		t.Fatalf("traceparent %q does not match any recorded span", traceparent)
+	}
+	if got, want := client.Parent().SpanID(), readProduction.SpanContext().SpanID(); got != want {
+		t.Errorf("propagated span %q has parent %v, want ReadProduction span %v", client.Name(), got, want)
+	}
+}
+
+func TestReadMeterOnce(t *testing.T) {
+	reader := newTestGateway(t, nil)
+
+	ctx, root := spans.Provider.Tracer("test").Start(context.Background(), "test")
+	if err := readMeterOnce(ctx, reader); err != nil {
+		t.Fatalf("readMeterOnce failed: %v", err)
+	}
+	root.End()
+
+	inTrace := spansInTrace(root.SpanContext().TraceID())
+	read := findSpan(t, inTrace, "MeterReader-Read")
+	readProduction := findSpan(t, inTrace, "ReadProduction")
+	parseProduction := findSpan(t, inTrace, "ParseProduction")
+	if got, want := readProduction.Parent().SpanID(), read.SpanContext().SpanID(); got != want {
+		t.Errorf("ReadProduction has parent %v, want MeterReader-Read span %v", got, want)
+	}
+	if got, want := parseProduction.Parent().SpanID(), readProduction.SpanContext().SpanID(); got != want {
+		t.Errorf("ParseProduction has parent %v, want ReadProduction span %v", got, want)
+	}
+
+	assertMeasurementCounts(t, readProduction, 1, 0)
+
+	events := make(map[string]bool)
+	for _, event := range readProduction.Events() {
+		events[event.Name] = true
+	}
+	for _, name := range []string{"doing http request", "got http response", "read production", "observed production"} {
+		if !events[name] {
+			t.Errorf("ReadProduction span has no %q event; got %v", name, events)
+		}
+	}
+
+	rm, err := metricReader.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("failed to collect metrics: %v", err)
+	}
+	var values []float64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != metricName("production") {
+				continue
+			}
+			gauge, ok := m.Data.(metricdata.Gauge[float64])
+			if !ok {
+				t.Fatalf("metric %q is a %T, want a float64 gauge", m.Name, m.Data)
+			}
+			for _, dp := range gauge.DataPoints {
+				values = append(values, dp.Value)
+			}
+		}
+	}
+	if len(values) != 1 || values[0] != 1234.5 {
+		t.Errorf("production gauge reported %v, want [1234.5]", values)
+	}
+}
+
+func TestRecordMissingAsZero(t *testing.T) {
+	for _, tc := range []struct {
+		recordMissingAsZero bool
+		want                float64
+	}{
+		// The gauge keeps reporting the last consumption seen.
+		{recordMissingAsZero: false, want: 42},
+		{recordMissingAsZero: true, want: 0},
+	} {
+		t.Run(fmt.Sprint(tc.recordMissingAsZero), func(t *testing.T) {
+			consumption.Observe(context.Background(), 42)
+
+			reader := &MeterReader{RecordMissingAsZero: tc.recordMissingAsZero}
+			// productionJSON has no consumption measurements.
+			if err := reader.processProduction(context.Background(), "test", []byte(productionJSON), time.Now()); err != nil {
+				t.Fatalf("processProduction failed: %v", err)
+			}
+
+			if got, _ := consumption.Value(); got != tc.want {
+				t.Errorf("consumption gauge is %v, want %v", got, tc.want)
+			}
+			if got, _ := production.Value(); got != 1234.5 {
+				t.Errorf("production gauge is %v, want 1234.5", got)
+			}
+		})
+	}
+}
+
+// assertMeasurementCounts checks the measurement counts recorded on a ReadProduction span.
+func assertMeasurementCounts(t *testing.T, span sdktrace.ReadOnlySpan, production, consumption int64) {
+	t.Helper()
+
+	got := make(map[attribute.Key]int64)
+	for _, kv := range span.Attributes() {
+		got[kv.Key] = kv.Value.AsInt64()
+	}
+	if got["measurements.production"] != production || got["measurements.consumption"] != consumption {
+		t.Errorf("span has measurements.production=%d and measurements.consumption=%d, want %d and %d",
+			got["measurements.production"], got["measurements.consumption"], production, consumption)
+	}
+}
+
+func TestProcessProductionCountsMeasurements(t *testing.T) {
+	// Only eim production and total-consumption measurements are recorded.
+	const payload = `{
+		"production": [
+			{"type": "inverters", "activeCount": 20, "readingTime": 1700000000, "wNow": 1200},
+			{"type": "eim", "measurementType": "production", "readingTime": 1700000000, "wNow": 1234.5}
+		],
+		"consumption": [
+			{"type": "eim", "measurementType": "total-consumption", "readingTime": 1700000000, "wNow": 800},
+			{"type": "eim", "measurementType": "net-consumption", "readingTime": 1700000000, "wNow": -434.5}
+		]
+	}`
+
+	ctx, span, _ := tracer.Start(context.Background(), "ReadProduction")
+	reader := &MeterReader{}
+	if err := reader.processProduction(ctx, "test", []byte(payload), time.Now()); err != nil {
+		t.Fatalf("processProduction failed: %v", err)
+	}
+	span.End()
+
+	inTrace := spansInTrace(span.SpanContext().TraceID())
+	assertMeasurementCounts(t, findSpan(t, inTrace, "ReadProduction"), 1, 1)
+}
+
+// writeChunked writes b to w in small flushed chunks, so it is sent chunked, without a Content-Length.
+func writeChunked(w http.ResponseWriter, b []byte) {
+	flusher := w.(http.Flusher)
+	for len(b) != 0 {
+		n := 7
+		if n > len(b) {
+			n = len(b)
+		}
+		w.Write(b[:n])
+		flusher.Flush()
+		b = b[n:]
+	}
+}
+
+func TestReadProductionChunked(t *testing.T) {
+	var mutex sync.Mutex
+	var contentLength string
+	reader := newTestGatewayHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		writeChunked(w, []byte(productionJSON))
+	})
+	reader.httpClient.Transport = &headerRecorder{next: reader.httpClient.Transport, record: func(h http.Header) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		contentLength = h.Get("Content-Length")
+	}}
+
+	production.Observe(context.Background(), 0)
+	if err := reader.ReadProduction(context.Background()); err != nil {
+		t.Fatalf("ReadProduction failed: %v", err)
+	}
+	if got, _ := production.Value(); got != 1234.5 {
+		t.Errorf("production gauge is %v, want 1234.5", got)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if contentLength != "" {
+		t.Errorf("response had Content-Length %q; the test needs a chunked response", contentLength)
+	}
+}
+
+func TestReadProductionTooLarge(t *testing.T) {
+	reader := newTestGatewayHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		// Valid JSON, so only the size can be rejected.
+		body := `{"production":[],"consumption":[],"padding":"` + strings.Repeat("x", maxResponseBytes) + `"}`
+		writeChunked(w, []byte(body))
+	})
+
+	err := reader.ReadProduction(context.Background())
+	var tooLarge *ResponseTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("ReadProduction returned %v, want a ResponseTooLargeError", err)
+	}
+	if tooLarge.Limit != maxResponseBytes {
+		t.Errorf("ResponseTooLargeError has limit %d, want %d", tooLarge.Limit, maxResponseBytes)
+	}
+}
+
+func TestReadResponseBodyLimit(t *testing.T) {
+	const limit = 10
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{body: ""},
+		{body: strings.Repeat("x", limit)},
+		{body: strings.Repeat("x", limit+1), wantErr: true},
+	} {
+		b, err := readResponseBody("http://gateway/production.json", strings.NewReader(tc.body), limit)
+		var tooLarge *ResponseTooLargeError
+		switch {
+		case tc.wantErr && !errors.As(err, &tooLarge):
+			t.Errorf("reading %d bytes returned %v, want a ResponseTooLargeError", len(tc.body), err)
+		case !tc.wantErr && (err != nil || string(b) != tc.body):
+			t.Errorf("reading %d bytes returned %d bytes and %v, want the body", len(tc.body), len(b), err)
+		}
+	}
+}
+
+// headerRecorder is a RoundTripper that passes the response headers to record.
+type headerRecorder struct {
+	next   http.RoundTripper
+	record func(http.Header)
+}
+
+func (t *headerRecorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	response, err := t.next.RoundTrip(r)
+	if err == nil {
+		t.record(response.Header)
+	}
+	return response, err
+}
+
+func TestMeasurementUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		json    string
+		want    Measurement
+		wantErr bool
+	}{
+		{
+			name: "numbers",
+			json: `{"type":"eim","readingTime":1700000000,"wNow":1234.5,"whLifetime":98765.25}`,
+			want: Measurement{Type: "eim", ReadingTime: 1700000000, WattsNow: 1234.5, WattHoursLifetime: 98765.25},
+		},
+		{
+			name: "strings",
+			json: `{"type":"eim","readingTime":"1700000000","wNow":"1234.5","whLifetime":" 98765.25 "}`,
+			want: Measurement{Type: "eim", ReadingTime: 1700000000, WattsNow: 1234.5, WattHoursLifetime: 98765.25},
+		},
+		{
+			name: "empty strings",
+			json: `{"type":"eim","readingTime":"","wNow":"","whLifetime":""}`,
+			want: Measurement{Type: "eim"},
+		},
+		{
+			name: "null and absent",
+			json: `{"type":"eim","wNow":null}`,
+			want: Measurement{Type: "eim"},
+		},
+		{
+			name: "negative",
+			json: `{"wNow":"-12.5"}`,
+			want: Measurement{WattsNow: -12.5},
+		},
+		{name: "invalid string", json: `{"wNow":"lots"}`, wantErr: true},
+		{name: "fractional reading time", json: `{"readingTime":"1700000000.5"}`, wantErr: true},
+		{name: "wrong type", json: `{"wNow":true}`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got Measurement
+			err := json.Unmarshal([]byte(tc.json), &got)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("parsed %s as %+v, want an error", tc.json, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", tc.json, err)
+			}
+			if got != tc.want {
+				t.Errorf("parsed %s as %+v, want %+v", tc.json, got, tc.want)
+			}
+		})
+	}
+}
@@ -3,63 +3,356 @@ package main
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"go.opentelemetry.io/otel/metric/global"
+	"github.com/justinsb/experiments-slog/energymonitor/kslog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/metric/instrument"
 	"go.opentelemetry.io/otel/metric/instrument/asyncfloat64"
 	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
-	"k8s.io/klog/v2"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/unit"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
+	"go.opentelemetry.io/otel/sdk/metric/view"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
-func init() {
-	if err := initMetrics(); err != nil {
-		klog.Fatalf("failed to init metrics: %v", err)
+// PowerInstruments selects which instruments report power readings.
+// It implements flag.Value.
+type PowerInstruments string
+
+const (
+	PowerInstrumentsGauge     PowerInstruments = "gauge"
+	PowerInstrumentsHistogram PowerInstruments = "histogram"
+	PowerInstrumentsBoth      PowerInstruments = "both"
+)
+
+func (p *PowerInstruments) String() string {
+	return string(*p)
+}
+
+func (p *PowerInstruments) Set(s string) error {
+	switch v := PowerInstruments(s); v {
+	case PowerInstrumentsGauge, PowerInstrumentsHistogram, PowerInstrumentsBoth:
+		*p = v
+		return nil
+	default:
+		return fmt.Errorf("unknown power instruments %q (must be gauge, histogram or both)", s)
 	}
 }
 
+func (p PowerInstruments) gauge() bool {
+	return p == PowerInstrumentsGauge || p == PowerInstrumentsBoth
+}
+
+func (p PowerInstruments) histogram() bool {
+	return p == PowerInstrumentsHistogram || p == PowerInstrumentsBoth
+}
+
+// powerInstruments is the instrument strategy for power readings; set from the -power-instruments flag.
+var powerInstruments = PowerInstrumentsGauge
+
+// defaultPowerHistogramBuckets are bucket boundaries (in watts) suited to home solar and consumption.
+var defaultPowerHistogramBuckets = []float64{0, 50, 100, 250, 500, 750, 1000, 1500, 2000, 3000, 4000, 5000, 6000, 8000, 10000}
+
+// BucketsFlag is a flag.Value holding comma-separated histogram bucket boundaries.
+type BucketsFlag []float64
+
+func (b *BucketsFlag) String() string {
+	var s []string
+	for _, v := range *b {
+		s = append(s, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return strings.Join(s, ",")
+}
+
+func (b *BucketsFlag) Set(s string) error {
+	var buckets []float64
+	for _, token := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(token), 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket boundary %q: %w", token, err)
+		}
+		if len(buckets) != 0 && v <= buckets[len(buckets)-1] {
+			return fmt.Errorf("bucket boundaries must be increasing, got %v after %v", v, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, v)
+	}
+	*b = buckets
+	return nil
+}
+
+// powerHistogramViews returns the views that apply our bucket boundaries to the power histograms.
+func powerHistogramViews(buckets []float64) ([]view.View, error) {
+	var views []view.View
+	for _, name := range []string{metricName("production-sync"), metricName("consumption-sync")} {
+		v, err := view.New(
+			view.MatchInstrumentName(name),
+			view.WithSetAggregation(aggregation.ExplicitBucketHistogram{Boundaries: buckets}),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error creating view for %q: %w", name, err)
+		}
+		views = append(views, v)
+	}
+	// Instruments that match no view are dropped, so finish with the default (match-all) view.
+	views = append(views, view.View{})
+	return views, nil
+}
+
 var consumption Gauge
 var production Gauge
 var consumptionSync syncfloat64.Histogram
 var productionSync syncfloat64.Histogram
+var authFailures syncint64.Counter
+var droppedSpans syncint64.Counter
+var requestDuration syncfloat64.Histogram
 
+// Gauge holds the most recent observed value, and reports it to the
+// underlying async gauge when the metric reader collects.
+//
+// The OpenTelemetry metrics API doesn't let us supply a timestamp, so the
+// exported sample is stamped with the collection time rather than the
+// gateway's reading time; the two can differ by up to a poll interval. The
+// gateway reading time is recorded on the ReadProduction span (and its
+// events) so downstream consumers can correct for the skew.
 type Gauge struct {
+	name  string
 	inner asyncfloat64.Gauge
-	value float64
+
+	mutex    sync.Mutex
+	value    float64
+	hasValue bool
 }
 
 func (g *Gauge) Observe(ctx context.Context, value float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
 	g.value = value
+	g.hasValue = true
 }
+
+// Value returns the most recent observed value, and false if nothing has been observed yet.
+func (g *Gauge) Value() (float64, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.value, g.hasValue
+}
+
 func (g *Gauge) callback(ctx context.Context) {
-	g.inner.Observe(ctx, g.value)
+	value, ok := g.Value()
+	if !ok {
+		return
+	}
+	g.inner.Observe(ctx, value)
+
+	if debugMetricCallbacks {
+		kslog.FromContext(ctx).Info("reported gauge", slog.String("gauge", g.name), slog.Float64("value", value))
+	}
+}
+
+// LifetimeCounter reports a cumulative energy reading from the gateway as a monotonic counter.
+// The gateway's lifetime counter goes back to (near) zero if it is reset, for example
+// by a reboot; we then carry the last value forward as an offset, so the exported
+// counter keeps increasing, as backends expect of counters.
+// The offset is only held in memory, so a restart of energymonitor is itself seen as a counter reset.
+//
+// A reset is only detected by a value lower than the previous sample: if the counter is reset
+// and then climbs past the previous value before the next sample, the reset is never seen,
+// and the energy counted before it is lost from the exported counter.
+type LifetimeCounter struct {
+	name  string
+	inner asyncfloat64.Counter
+
+	mutex    sync.Mutex
+	offset   float64
+	last     float64
+	hasValue bool
+}
+
+// Observe records the gateway's current lifetime value.
+func (c *LifetimeCounter) Observe(ctx context.Context, raw float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.hasValue && raw < c.last {
+		kslog.FromContext(ctx).Warn("lifetime counter went backwards, assuming the gateway reset it", slog.String("counter", c.name), slog.Float64("previous", c.last), slog.Float64("value", raw))
+		c.offset += c.last
+	}
+	c.last = raw
+	c.hasValue = true
+}
+
+// Value returns the monotonic value (including any offset from resets), and false if nothing has been observed yet.
+func (c *LifetimeCounter) Value() (float64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.offset + c.last, c.hasValue
+}
+
+func (c *LifetimeCounter) callback(ctx context.Context) {
+	value, ok := c.Value()
+	if !ok {
+		return
+	}
+	c.inner.Observe(ctx, value)
+
+	if debugMetricCallbacks {
+		kslog.FromContext(ctx).Info("reported counter", slog.String("counter", c.name), slog.Float64("value", value))
+	}
+}
+
+// clockSkew is the most recent difference between our clock and the gateway's reading time.
+var clockSkew Gauge
+
+var consumptionLifetime LifetimeCounter
+var productionLifetime LifetimeCounter
+
+// lifetimeCounters enables exporting the lifetime watt-hour counters; set from the -lifetime-counters flag.
+var lifetimeCounters bool
+
+// metricPrefix is prepended to all our instrument names, to avoid clashes in a shared backend;
+// set from the -metric-prefix flag.
+var metricPrefix string
+
+// metricName returns the instrument name for name, with metricPrefix applied.
+func metricName(name string) string {
+	return metricPrefix + name
 }
 
-func initMetrics() error {
-	meter := global.Meter("justinsb.com/energy")
+// startTime is when the process started, for the uptime metric; set at the start of run.
+var startTime time.Time
+
+// debugMetricCallbacks traces each run of the gauge callback, so the timing of
+// async reporting relative to reads is visible; set from the -debug-metric-callbacks flag.
+var debugMetricCallbacks bool
+
+// InitMetrics creates our instruments on the given meter.
+func InitMetrics(meter metric.Meter) error {
 	var err error
-	consumptionInner, err := meter.AsyncFloat64().Gauge("consumption", instrument.WithDescription("current consumption"))
+	consumptionInner, err := meter.AsyncFloat64().Gauge(metricName("consumption"), instrument.WithDescription("current consumption"))
 	if err != nil {
 		return fmt.Errorf("error creating metric: %w", err)
 	}
+	consumption.name = metricName("consumption")
 	consumption.inner = consumptionInner
-	productionInner, err := meter.AsyncFloat64().Gauge("production", instrument.WithDescription("current production"))
+	productionInner, err := meter.AsyncFloat64().Gauge(metricName("production"), instrument.WithDescription("current production"))
 	if err != nil {
 		return fmt.Errorf("error creating metric: %w", err)
 	}
+	production.name = metricName("production")
 	production.inner = productionInner
 	meter.RegisterCallback([]instrument.Asynchronous{consumptionInner, productionInner},
 		func(ctx context.Context) {
+			if !powerInstruments.gauge() {
+				return
+			}
+			if debugMetricCallbacks {
+				var span trace.Span
+				ctx, span, _ = tracer.Start(ctx, "GaugeCallback")
+				defer span.End()
+			}
 			consumption.callback(ctx)
 			production.callback(ctx)
 		})
 
-	consumptionSync, err = meter.SyncFloat64().Histogram("consumption-sync", instrument.WithDescription("current consumption"))
+	consumptionLifetimeInner, err := meter.AsyncFloat64().Counter(metricName("consumption-lifetime"), instrument.WithDescription("lifetime energy consumed, in watt-hours"))
+	if err != nil {
+		return fmt.Errorf("error creating metric: %w", err)
+	}
+	consumptionLifetime.name = metricName("consumption-lifetime")
+	consumptionLifetime.inner = consumptionLifetimeInner
+	productionLifetimeInner, err := meter.AsyncFloat64().Counter(metricName("production-lifetime"), instrument.WithDescription("lifetime energy produced, in watt-hours"))
+	if err != nil {
+		return fmt.Errorf("error creating metric: %w", err)
+	}
+	productionLifetime.name = metricName("production-lifetime")
+	productionLifetime.inner = productionLifetimeInner
+	meter.RegisterCallback([]instrument.Asynchronous{consumptionLifetimeInner, productionLifetimeInner},
+		func(ctx context.Context) {
+			if !lifetimeCounters {
+				return
+			}
+			consumptionLifetime.callback(ctx)
+			productionLifetime.callback(ctx)
+		})
+
+	clockSkewInner, err := meter.AsyncFloat64().Gauge(metricName("clock_skew_seconds"), instrument.WithDescription("how far the gateway's reading time lags our clock (negative if it is ahead)"), instrument.WithUnit(unit.Unit("s")))
+	if err != nil {
+		return fmt.Errorf("error creating metric: %w", err)
+	}
+	clockSkew.name = metricName("clock_skew_seconds")
+	clockSkew.inner = clockSkewInner
+	meter.RegisterCallback([]instrument.Asynchronous{clockSkewInner},
+		func(ctx context.Context) {
+			clockSkew.callback(ctx)
+		})
+
+	uptime, err := meter.AsyncFloat64().Gauge(metricName("process_uptime_seconds"), instrument.WithDescription("time since energymonitor started"), instrument.WithUnit(unit.Unit("s")))
+	if err != nil {
+		return fmt.Errorf("error creating metric: %w", err)
+	}
+	meter.RegisterCallback([]instrument.Asynchronous{uptime},
+		func(ctx context.Context) {
+			if startTime.IsZero() {
+				return
+			}
+			uptime.Observe(ctx, time.Since(startTime).Seconds())
+		})
+
+	consumptionSync, err = meter.SyncFloat64().Histogram(metricName("consumption-sync"), instrument.WithDescription("current consumption"))
+	if err != nil {
+		return fmt.Errorf("error creating metric: %w", err)
+	}
+	productionSync, err = meter.SyncFloat64().Histogram(metricName("production-sync"), instrument.WithDescription("current production"))
+	if err != nil {
+		return fmt.Errorf("error creating metric: %w", err)
+	}
+
+	authFailures, err = meter.SyncInt64().Counter(metricName("auth-failures"), instrument.WithDescription("requests rejected by the gateway as unauthorized"))
 	if err != nil {
 		return fmt.Errorf("error creating metric: %w", err)
 	}
-	productionSync, err = meter.SyncFloat64().Histogram("production-sync", instrument.WithDescription("current production"))
+
+	droppedSpans, err = meter.SyncInt64().Counter(metricName("dropped-spans"), instrument.WithDescription("spans lost before reaching the collector, by reason: export_failed, or queue_full when the export queue overflowed"))
+	if err != nil {
+		return fmt.Errorf("error creating metric: %w", err)
+	}
+
+	requestDuration, err = meter.SyncFloat64().Histogram(metricName("gateway-request-duration"), instrument.WithDescription("duration of http requests to the gateway, by endpoint"), instrument.WithUnit(unit.Milliseconds))
 	if err != nil {
 		return fmt.Errorf("error creating metric: %w", err)
 	}
 	return nil
 }
+
+// recordProduction records a production reading on the instruments selected by powerInstruments.
+// The latest value is always kept on the gauge, but only reported to otel if gauges are selected.
+// The histogram is labeled with the allowlisted context attributes; the gauge holds a single value, so is not.
+func recordProduction(ctx context.Context, watts float64) {
+	if powerInstruments.histogram() {
+		productionSync.Record(ctx, watts, metricAttributes(ctx)...)
+	}
+	production.Observe(ctx, watts)
+}
+
+// recordConsumption records a consumption reading on the instruments selected by powerInstruments.
+// The latest value is always kept on the gauge, but only reported to otel if gauges are selected.
+// The histogram is labeled with the allowlisted context attributes; the gauge holds a single value, so is not.
+func recordConsumption(ctx context.Context, watts float64) {
+	if powerInstruments.histogram() {
+		consumptionSync.Record(ctx, watts, metricAttributes(ctx)...)
+	}
+	consumption.Observe(ctx, watts)
+}
+
+// recordRequestDuration records how long a request to the gateway took.
+// endpoint should be low-cardinality, see endpointRoute.
+func recordRequestDuration(ctx context.Context, endpoint string, d time.Duration) {
+	requestDuration.Record(ctx, float64(d)/float64(time.Millisecond), metricAttributes(ctx, attribute.String("endpoint", endpoint))...)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLifetimeCounterReset(t *testing.T) {
+	c := &LifetimeCounter{name: "test"}
+	if _, ok := c.Value(); ok {
+		t.Errorf("counter has a value before any observation")
+	}
+
+	// The gateway resets from 150 to 10, and again (to 0) before climbing.
+	raw := []float64{100, 150, 10, 0, 20, 30}
+	want := []float64{100, 150, 160, 160, 180, 190}
+	previous := 0.0
+	for i, v := range raw {
+		c.Observe(context.Background(), v)
+		got, ok := c.Value()
+		if !ok {
+			t.Fatalf("counter has no value after observing %v", v)
+		}
+		if got != want[i] {
+			t.Errorf("after observing %v, counter is %v, want %v", v, got, want[i])
+		}
+		if got < previous {
+			t.Errorf("counter went backwards, from %v to %v, after observing %v", previous, got, v)
+		}
+		previous = got
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/justinsb/experiments-slog/energymonitor/attrs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	sourceHTTP = "http"
+	sourceMQTT = "mqtt"
+)
+
+// mqttConfig holds the options for readMQTTForever.
+type mqttConfig struct {
+	// Broker is the broker URL, e.g. tcp://localhost:1883.
+	Broker string
+	// Topic is the topic (or topic filter) that readings are published to.
+	Topic string
+	// ClientID identifies us to the broker; it must be unique among the broker's clients.
+	ClientID string
+
+	// Username and Password are read from MQTT_USERNAME and MQTT_PASSWORD.
+	Username string
+	Password string
+}
+
+// readMQTTForever subscribes to cfg.Topic and records each message as a Reading
+// until ctx is cancelled. This is for meters that push their readings, rather than
+// being polled by MeterReader.
+//
+// Each message is a JSON Reading, e.g. {"kind":"production","watts":1234.5,"readingTime":"2023-01-02T15:04:05Z"}.
+// If readingTime is omitted, the time the message was received is used.
+func readMQTTForever(ctx context.Context, cfg mqttConfig) error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			slog.Warn("lost connection to mqtt broker", slog.String("broker", cfg.Broker), attrs.Error(err))
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// Subscriptions don't survive a reconnect to a clean session, so (re)subscribe on every connect.
+			slog.Info("connected to mqtt broker", slog.String("broker", cfg.Broker), slog.String("topic", cfg.Topic))
+			token := client.Subscribe(cfg.Topic, 0, func(client mqtt.Client, message mqtt.Message) {
+				handleMQTTMessage(ctx, message)
+			})
+			if token.Wait() && token.Error() != nil {
+				slog.Error("error subscribing to mqtt topic", attrs.Error(token.Error()), slog.String("topic", cfg.Topic))
+			}
+		})
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("error connecting to mqtt broker %q: %w", cfg.Broker, token.Error())
+	}
+	defer client.Disconnect(250)
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func handleMQTTMessage(ctx context.Context, message mqtt.Message) {
+	ctx, span, log := tracer.Start(ctx, "MQTTMessage", trace.WithAttributes(attribute.String("topic", message.Topic())))
+	defer span.End()
+
+	t := time.Now()
+
+	var reading Reading
+	if err := json.Unmarshal(message.Payload(), &reading); err != nil {
+		err = &ParseError{URL: "mqtt:" + message.Topic(), Err: err}
+		log.Error("error parsing mqtt message", attrs.Error(err))
+		return
+	}
+	reading.FetchTime = t
+	if reading.ReadingTime.IsZero() {
+		reading.ReadingTime = t
+	}
+
+	if err := recordReading(ctx, reading); err != nil {
+		log.Error("error recording mqtt message", attrs.Error(err), slog.String("topic", message.Topic()))
+	}
+}
+
+// mqttClientID returns a default MQTT client id, unique per host.
+func mqttClientID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "energymonitor"
+	}
+	return "energymonitor-" + hostname
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// openMetricsHandler serves the latest readings in the OpenMetrics text format,
+// with stable metric names, for scrapers such as Home Assistant or Prometheus.
+// It is independent of the OTLP metrics pipeline.
+type openMetricsHandler struct{}
+
+func (h *openMetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+
+	productionWatts, hasProduction := production.Value()
+	consumptionWatts, hasConsumption := consumption.Value()
+
+	if hasProduction {
+		writeOpenMetricsGauge(&b, "energymonitor_production_watts", "Current power production.", productionWatts)
+	}
+	if hasConsumption {
+		writeOpenMetricsGauge(&b, "energymonitor_consumption_watts", "Current power consumption.", consumptionWatts)
+	}
+	if hasProduction && hasConsumption {
+		writeOpenMetricsGauge(&b, "energymonitor_net_watts", "Current net power drawn from the grid (consumption minus production).", consumptionWatts-productionWatts)
+	}
+	b.WriteString("# EOF\n")
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func writeOpenMetricsGauge(b *bytes.Buffer, name string, help string, value float64) {
+	fmt.Fprintf(b, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(b, "# UNIT %s watts\n", name)
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "%s %g\n", name, value)
+}
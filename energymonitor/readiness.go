@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessFirstRead is ready once any reading has been recorded.
+	readinessFirstRead = "first-read"
+	// readinessRecent is ready while a reading was recorded within MaxAge.
+	readinessRecent = "recent"
+	// readinessProbe is ready while a lightweight request to the gateway succeeds.
+	readinessProbe = "probe"
+)
+
+// readiness backs /readyz; readings mark it successful as they are recorded.
+var readiness Readiness
+
+// Readiness decides whether we are ready, according to Mode.
+type Readiness struct {
+	// Mode is readinessFirstRead, readinessRecent or readinessProbe.
+	Mode string
+	// MaxAge is how recent the last reading must be, with readinessRecent.
+	MaxAge time.Duration
+	// Probe checks the gateway is reachable, with readinessProbe.
+	Probe func(ctx context.Context) error
+	// ProbeInterval is how long a probe result is reused, so that frequent
+	// readiness checks don't hammer the gateway.
+	ProbeInterval time.Duration
+
+	mutex       sync.Mutex
+	lastSuccess time.Time
+
+	// probeMutex guards the cached probe result. It is separate from mutex, so that
+	// a slow probe doesn't block RecordSuccess (and so the reading path).
+	probeMutex sync.Mutex
+	lastProbe  time.Time
+	probeErr   error
+}
+
+// RecordSuccess notes that a reading was recorded at t.
+func (r *Readiness) RecordSuccess(t time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lastSuccess = t
+}
+
+// Check returns nil if we are ready, or an error explaining why not.
+func (r *Readiness) Check(ctx context.Context) error {
+	if r.Mode == readinessProbe {
+		return r.checkProbe(ctx)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch r.Mode {
+	case readinessRecent:
+		if r.lastSuccess.IsZero() {
+			return fmt.Errorf("no reading recorded yet")
+		}
+		if age := time.Since(r.lastSuccess); age > r.MaxAge {
+			return fmt.Errorf("last reading was %v ago", age.Round(time.Second))
+		}
+		return nil
+
+	default:
+		if r.lastSuccess.IsZero() {
+			return fmt.Errorf("no reading recorded yet")
+		}
+		return nil
+	}
+}
+
+// checkProbe returns the result of the last probe, probing the gateway again if it is older than ProbeInterval.
+func (r *Readiness) checkProbe(ctx context.Context) error {
+	// Probes are serialized by probeMutex, so concurrent checks wait for the probe in flight and share its result.
+	r.probeMutex.Lock()
+	defer r.probeMutex.Unlock()
+
+	if r.lastProbe.IsZero() || time.Since(r.lastProbe) >= r.ProbeInterval {
+		r.probeErr = r.Probe(ctx)
+		r.lastProbe = time.Now()
+	}
+	if r.probeErr != nil {
+		return fmt.Errorf("gateway unreachable: %w", r.probeErr)
+	}
+	return nil
+}
+
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := r.Check(req.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
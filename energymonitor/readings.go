@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/justinsb/experiments-slog/energymonitor/kslog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// Reading is a single power measurement parsed from the gateway.
+type Reading struct {
+	// Kind is ReadingKindProduction or ReadingKindConsumption.
+	Kind  string  `json:"kind"`
+	Watts float64 `json:"watts"`
+	// WattHoursLifetime is the gateway's cumulative energy counter, or zero if not reported.
+	WattHoursLifetime float64 `json:"wattHoursLifetime,omitempty"`
+
+	// ReadingTime is when the gateway took the measurement.
+	ReadingTime time.Time `json:"readingTime"`
+	// FetchTime is when we fetched the measurement from the gateway.
+	FetchTime time.Time `json:"fetchTime"`
+}
+
+const (
+	ReadingKindProduction  = "production"
+	ReadingKindConsumption = "consumption"
+)
+
+// recordReading records a reading, whatever its source: on the metrics, on the span in ctx,
+// and to subscribers of readings.
+// It returns an error if the reading's Kind is not recognized.
+func recordReading(ctx context.Context, reading Reading) error {
+	span := trace.SpanFromContext(ctx)
+	log := kslog.FromContext(ctx)
+
+	var lifetime *LifetimeCounter
+	switch reading.Kind {
+	case ReadingKindProduction:
+		recordProduction(ctx, reading.Watts)
+		lifetime = &productionLifetime
+	case ReadingKindConsumption:
+		recordConsumption(ctx, reading.Watts)
+		lifetime = &consumptionLifetime
+	default:
+		return fmt.Errorf("unknown reading kind %q", reading.Kind)
+	}
+	// Zero means not reported; a genuine reset to zero is caught by the next (smaller) value.
+	if reading.WattHoursLifetime != 0 {
+		lifetime.Observe(ctx, reading.WattHoursLifetime)
+	}
+
+	checkClockSkew(ctx, reading)
+
+	// Zero if the gateway didn't report a reading time.
+	var readingTime int64
+	if !reading.ReadingTime.IsZero() {
+		readingTime = reading.ReadingTime.Unix()
+	}
+	log.Info("read "+reading.Kind, slog.Int64("time", reading.FetchTime.UnixNano()), slog.Int64("reading_time", readingTime), slog.Float64("watts", reading.Watts))
+
+	readings.Publish(reading)
+	readiness.RecordSuccess(reading.FetchTime)
+
+	span.SetAttributes(attribute.Int64(reading.Kind+".reading_time", readingTime))
+	span.AddEvent("observed "+reading.Kind, trace.WithAttributes(attribute.Float64("value", reading.Watts), attribute.Int64("reading_time", readingTime)))
+	return nil
+}
+
+// clockSkewThreshold is how far the gateway's reading time may differ from when we fetched
+// the reading before we warn; zero disables the warning (the skew is still recorded).
+// Set from the -clock-skew-threshold flag.
+var clockSkewThreshold = 2 * time.Minute
+
+// recordClockSkew enables checkClockSkew; it is cleared when replaying captures,
+// which are from the past, so their skew is meaningless.
+var recordClockSkew = true
+
+// checkClockSkew records the difference between when we fetched the reading and the gateway's
+// reading time, warning if it exceeds clockSkewThreshold. Large skew explains misaligned samples.
+func checkClockSkew(ctx context.Context, reading Reading) {
+	if !recordClockSkew || reading.ReadingTime.IsZero() || reading.FetchTime.IsZero() {
+		return
+	}
+
+	skew := reading.FetchTime.Sub(reading.ReadingTime)
+	clockSkew.Observe(ctx, skew.Seconds())
+
+	if clockSkewThreshold == 0 {
+		return
+	}
+	if skew > clockSkewThreshold || skew < -clockSkewThreshold {
+		kslog.FromContext(ctx).Warn("gateway reading time differs from our clock", slog.String("kind", reading.Kind), slog.Float64("skew_seconds", skew.Seconds()), slog.Float64("threshold_seconds", clockSkewThreshold.Seconds()))
+	}
+}
+
+// readings publishes each Reading as it is parsed.
+var readings ReadingBroadcaster
+
+// ReadingBroadcaster fans out readings to any number of subscribers.
+type ReadingBroadcaster struct {
+	mutex       sync.Mutex
+	subscribers map[chan Reading]struct{}
+}
+
+// Subscribe returns a channel that receives subsequent readings, and a func to unsubscribe.
+// Readings are dropped for subscribers that fall behind, rather than blocking the reader.
+func (b *ReadingBroadcaster) Subscribe() (<-chan Reading, func()) {
+	ch := make(chan Reading, 16)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Reading]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
+
+// Publish sends the reading to all current subscribers.
+func (b *ReadingBroadcaster) Publish(reading Reading) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- reading:
+		default:
+		}
+	}
+}
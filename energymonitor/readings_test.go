@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justinsb/experiments-slog/energymonitor/kslog"
+	"golang.org/x/exp/slog"
+)
+
+func TestCheckClockSkew(t *testing.T) {
+	defer func(threshold time.Duration) { clockSkewThreshold = threshold }(clockSkewThreshold)
+
+	fetchTime := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	// The gateway's clock is ten minutes behind ours.
+	stale := Reading{Kind: ReadingKindProduction, FetchTime: fetchTime, ReadingTime: fetchTime.Add(-10 * time.Minute)}
+	// The gateway's response had no readingTime.
+	missing := Reading{Kind: ReadingKindProduction, FetchTime: fetchTime, ReadingTime: (&Measurement{}).readingTime()}
+
+	for _, tc := range []struct {
+		name      string
+		reading   Reading
+		threshold time.Duration
+		// wantSkew is the recorded skew in seconds, or nil if none should be recorded.
+		wantSkew *float64
+		wantWarn bool
+	}{
+		{name: "over threshold", reading: stale, threshold: 2 * time.Minute, wantSkew: ptr(600.0), wantWarn: true},
+		{name: "under threshold", reading: stale, threshold: time.Hour, wantSkew: ptr(600.0), wantWarn: false},
+		// The gauge is recorded whatever the threshold.
+		{name: "warning disabled", reading: stale, threshold: 0, wantSkew: ptr(600.0), wantWarn: false},
+		{name: "no reading time", reading: missing, threshold: 2 * time.Minute, wantSkew: nil, wantWarn: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clockSkewThreshold = tc.threshold
+			clockSkew.mutex.Lock()
+			clockSkew.hasValue = false
+			clockSkew.mutex.Unlock()
+
+			var buf bytes.Buffer
+			ctx := kslog.NewContext(context.Background(), slog.New(slog.HandlerOptions{}.NewTextHandler(&buf)))
+			checkClockSkew(ctx, tc.reading)
+
+			got, ok := clockSkew.Value()
+			switch {
+			case tc.wantSkew == nil && ok:
+				t.Errorf("clock skew gauge is %v, want no value", got)
+			case tc.wantSkew != nil && (!ok || got != *tc.wantSkew):
+				t.Errorf("clock skew gauge is %v (set %v), want %v", got, ok, *tc.wantSkew)
+			}
+			if gotWarn := strings.Contains(buf.String(), "gateway reading time differs from our clock"); gotWarn != tc.wantWarn {
+				t.Errorf("warned=%v, want %v; logged:\n%s", gotWarn, tc.wantWarn, buf.String())
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/justinsb/experiments-slog/energymonitor/attrs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// replayProduction feeds the production.json captures in dir through the same parsing and
+// recording as a live read, one every interval, in filename order.
+// Captures are expected to be named so that they sort by time (e.g. by timestamp).
+func replayProduction(ctx context.Context, clock Clock, reader *MeterReader, dir string, interval time.Duration) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading replay directory %q: %w", dir, err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(paths)
+
+	slog.Info("replaying captures", slog.String("dir", dir), slog.Int("count", len(paths)))
+
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i, p := range paths {
+		if i != 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C():
+			}
+		}
+
+		if err := replayOnce(ctx, clock, reader, p); err != nil {
+			slog.Error("error replaying capture", attrs.Error(err), slog.String("path", p))
+		}
+	}
+
+	return nil
+}
+
+func replayOnce(ctx context.Context, clock Clock, reader *MeterReader, p string) error {
+	ctx, span, _ := tracer.Start(ctx, "ReplayProduction", trace.WithAttributes(attribute.String("path", p)))
+	defer span.End()
+
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %w", p, err)
+	}
+
+	return reader.processProduction(ctx, p, b, clock.Now())
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/exp/slog"
+)
+
+// sampleProduction fetches production.json from the gateway once and writes the raw
+// response to path, so users can send us a representative capture (e.g. for -replay-dir).
+// Nothing is redacted, so we warn that the capture may contain sensitive details.
+func sampleProduction(ctx context.Context, reader *MeterReader, path string) error {
+	ctx, span, log := tracer.Start(ctx, "SampleProduction")
+	defer span.End()
+
+	_, b, _, err := reader.fetchProduction(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("error writing sample to %q: %w", path, err)
+	}
+
+	log.Info("wrote sample gateway response", slog.String("path", path), slog.Int("bytes", len(b)))
+	log.Warn("the sample is not redacted and may contain sensitive details (such as device serial numbers); please review it before sharing", slog.String("path", path))
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	collectorlogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	collectormetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// runInspect implements `otelsink inspect <file>`, printing a captured file (proto or json) in a readable form.
+func runInspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print as protojson instead of prototext")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: otelsink inspect [--json] <file>")
+	}
+	p := flags.Arg(0)
+	if strings.HasSuffix(p, ".parquet") {
+		return fmt.Errorf("cannot inspect %q: parquet captures can be read with any parquet tool", p)
+	}
+
+	stream := streamForPath(p)
+	msg, err := newMessageForStream(stream)
+	if err != nil {
+		return fmt.Errorf("cannot inspect %q: %w", p, err)
+	}
+
+	b, err := readCapture(p)
+	if err != nil {
+		return err
+	}
+
+	if isSegment(p) {
+		// A segment holds a sequence of length-delimited exports.
+		r := bytes.NewReader(b)
+		for {
+			proto.Reset(msg)
+			if err := (protodelim.UnmarshalOptions{MaxSize: -1}).UnmarshalFrom(r, msg); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("failed to parse %q as %s: %w", p, stream, err)
+			}
+			if err := printMessage(msg, *asJSON); err != nil {
+				return err
+			}
+		}
+	}
+
+	unmarshal := proto.Unmarshal
+	if strings.HasSuffix(strings.TrimSuffix(p, ".gz"), ".json") {
+		unmarshal = protojson.Unmarshal
+	}
+	if err := unmarshal(b, msg); err != nil {
+		return fmt.Errorf("failed to parse %q as %s: %w", p, stream, err)
+	}
+	return printMessage(msg, *asJSON)
+}
+
+// printMessage prints msg to stdout, as prototext or (with asJSON) protojson.
+func printMessage(msg proto.Message, asJSON bool) error {
+	var out string
+	if asJSON {
+		out = protojson.Format(msg)
+	} else {
+		out = prototext.Format(msg)
+	}
+	_, err := fmt.Fprintln(os.Stdout, out)
+	return err
+}
+
+// streamForPath returns the stream a captured file belongs to: the nearest enclosing directory
+// named for a stream, as files are partitioned by day within the stream's directory.
+// If there is none, it returns the name of the file's directory.
+func streamForPath(p string) string {
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if _, err := newMessageForStream(filepath.Base(dir)); err == nil {
+			return filepath.Base(dir)
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+	return filepath.Base(filepath.Dir(p))
+}
+
+// newMessageForStream returns an empty request message of the type captured for the stream.
+func newMessageForStream(stream string) (proto.Message, error) {
+	switch stream {
+	case "traces":
+		return &collectortracepb.ExportTraceServiceRequest{}, nil
+	case "metrics":
+		return &collectormetricspb.ExportMetricsServiceRequest{}, nil
+	case "logs":
+		return &collectorlogspb.ExportLogsServiceRequest{}, nil
+	default:
+		return nil, fmt.Errorf("unknown stream %q", stream)
+	}
+}
+
+// readCapture reads a captured file, decompressing it if it has a .gz extension.
+func readCapture(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", p, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(p, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %q: %w", p, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", p, err)
+	}
+	return b, nil
+}
@@ -1,22 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/go-logr/logr/funcr"
+	"go.opentelemetry.io/otel/attribute"
 	collectorlogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
 	collectormetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
 	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 	"k8s.io/klog/v2"
@@ -36,16 +43,90 @@ func run(ctx context.Context) error {
 	klog.InitFlags(nil)
 
 	listen := "localhost:3000"
+	flag.StringVar(&listen, "listen", listen, "address on which to serve the OTLP GRPC services")
+	dataDir := "data"
+	flag.StringVar(&dataDir, "data-dir", dataDir, "directory in which to store the received telemetry, one subdirectory per stream")
+	compress := ""
+	flag.StringVar(&compress, "compress", compress, "compression for stored files: empty for none, or gzip")
+	format := formatProto
+	flag.StringVar(&format, "format", format, "format of stored files: proto, json (OTLP JSON, for reading and grepping), or parquet (metrics and traces flattened for analytics; logs stay proto)")
+	segmentSize := int64(defaultSegmentSize)
+	flag.Int64Var(&segmentSize, "segment-size", segmentSize, "with --format proto, append exports to rolling segment files per stream, rotated beyond this many bytes; 0 writes a file per export")
+	selfMetricsInterval := time.Minute
+	flag.DurationVar(&selfMetricsInterval, "self-metrics-interval", selfMetricsInterval, "how often to store otelsink's own metrics (such as export-duration) in the metrics stream; 0 disables them")
+	logFormat := "text"
+	flag.StringVar(&logFormat, "log-format", logFormat, "format of log output to stderr: text or json")
 	flag.Parse()
 
+	switch logFormat {
+	case "text":
+	case "json":
+		klog.SetLogger(funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, funcr.Options{
+			LogTimestamp: true,
+			// klog has already applied its -v filtering.
+			Verbosity: math.MaxInt32,
+		}))
+	default:
+		return fmt.Errorf("unknown --log-format value %q", logFormat)
+	}
+
+	if flag.Arg(0) == "inspect" {
+		return runInspect(flag.Args()[1:])
+	}
+
+	switch compress {
+	case "", "gzip":
+	default:
+		return fmt.Errorf("unknown --compress value %q", compress)
+	}
+
+	switch format {
+	case formatProto, formatJSON, formatParquet:
+	default:
+		return fmt.Errorf("unknown --format value %q", format)
+	}
+
 	sink := &Sink{
-		dir: "data",
+		dir:      dataDir,
+		namer:    timestampNamer,
+		format:   format,
+		compress: compress,
+	}
+	if format == formatProto {
+		sink.segmentSize = segmentSize
 	}
+	defer sink.Close()
+
+	shutdownMetrics, err := initMetrics(sink, selfMetricsInterval)
+	if err != nil {
+		return fmt.Errorf("failed to initialize metrics: %w", err)
+	}
+	defer func() {
+		// Write our final metrics before the sink is closed.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownMetrics(shutdownCtx); err != nil {
+			klog.ErrorS(err, "failed to write final metrics")
+		}
+	}()
 
 	ts := &traceServer{sink: sink}
 	ms := &metricsServer{sink: sink}
 	ls := &logsServer{sink: sink}
 
+	klog.InfoS("starting otelsink",
+		"listen", listen,
+		"dataDir", sink.dir,
+		"streams", []string{"traces", "metrics", "logs"},
+		"format", sink.format,
+		"compress", compress,
+		"segmentSize", sink.segmentSize,
+		"selfMetricsInterval", selfMetricsInterval,
+		"retention", "unlimited",
+	)
+
 	klog.Infof("listening on %q", listen)
 	lis, err := net.Listen("tcp", listen)
 	if err != nil {
@@ -114,23 +195,115 @@ func (s *logsServer) Export(ctx context.Context, req *collectorlogspb.ExportLogs
 
 }
 
+const (
+	formatProto   = "proto"
+	formatJSON    = "json"
+	formatParquet = "parquet"
+)
+
+// Namer returns the path (relative to the sink directory, without extension) at which to store msg.
+// With segments, only the directory is used: msg is appended to the current segment in that directory,
+// and a new segment is started when the directory changes.
+type Namer func(stream string, msg proto.Message) string
+
+// timestampNamer names each file by the time it was written, within a directory per stream and (UTC) day,
+// e.g. traces/2024/01/31/1706659200000000000.
+func timestampNamer(stream string, msg proto.Message) string {
+	now := time.Now().UTC()
+	return filepath.Join(stream, dayDir(now), strconv.FormatInt(now.UnixNano(), 10))
+}
+
+// dayDir is the relative directory for files written at t, partitioning each stream by day, e.g. 2024/01/31.
+func dayDir(t time.Time) string {
+	return filepath.Join(t.Format("2006"), t.Format("01"), t.Format("02"))
+}
+
 type Sink struct {
 	dir string
+
+	// namer names stored files (or, with segments, their directories); timestampNamer if nil.
+	namer Namer
+
+	// format is the format of stored files: formatProto, formatJSON or formatParquet.
+	format string
+
+	// compress is the compression applied to stored files; empty for none, or "gzip".
+	compress string
+
+	// segmentSize, if set, appends proto exports to segment files of up to this many bytes,
+	// instead of writing a file per export; see appendSegment.
+	segmentSize int64
+
+	// mutex guards segments, the open segment of each stream.
+	mutex    sync.Mutex
+	segments map[string]*segment
 }
 
+// Export writes msg to the stream, recording how long the write took.
 func (s *Sink) Export(ctx context.Context, stream string, msg proto.Message) error {
-	n := strconv.FormatInt(time.Now().UnixNano(), 10)
-	p := filepath.Join(s.dir, stream, n)
+	start := time.Now()
+	err := s.write(ctx, stream, msg)
+	duration := time.Since(start)
+
+	exportDuration.Record(ctx, duration.Seconds(), attribute.String("stream", stream))
+	klog.V(2).InfoS("wrote export", "stream", stream, "duration", duration, "success", err == nil)
+
+	return err
+}
+
+// name returns the path, relative to s.dir, at which to store msg; see Namer.
+func (s *Sink) name(stream string, msg proto.Message) string {
+	if s.namer == nil {
+		return timestampNamer(stream, msg)
+	}
+	return s.namer(stream, msg)
+}
+
+func (s *Sink) write(ctx context.Context, stream string, msg proto.Message) error {
+	if s.segmentSize > 0 {
+		return s.appendSegment(stream, msg)
+	}
+
+	p := filepath.Join(s.dir, s.name(stream, msg))
 
 	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
 		return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(p), err)
 	}
 
-	b, err := proto.Marshal(msg)
+	if s.format == formatParquet {
+		// With parquet, the compression is applied within the file.
+		if ok, err := writeParquet(p+".parquet", msg, s.compress); ok {
+			return err
+		}
+	}
+
+	var b []byte
+	var err error
+	if s.format == formatJSON {
+		p += ".json"
+		b, err = protojson.Marshal(msg)
+	} else {
+		p += ".pb"
+		b, err = proto.Marshal(msg)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to serialize message: %w", err)
 	}
 
+	if s.compress == "gzip" {
+		p += ".gz"
+
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(b); err != nil {
+			return fmt.Errorf("failed to compress message: %w", err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to compress message: %w", err)
+		}
+		b = buf.Bytes()
+	}
+
 	if err := os.WriteFile(p, b, 0644); err != nil {
 		return fmt.Errorf("failed to write file %q: %w", p, err)
 	}
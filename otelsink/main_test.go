@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSinkWriteRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		format   string
+		compress string
+		wantName string
+	}{
+		{format: formatProto, wantName: "export.pb"},
+		{format: formatProto, compress: "gzip", wantName: "export.pb.gz"},
+		{format: formatJSON, wantName: "export.json"},
+		{format: formatJSON, compress: "gzip", wantName: "export.json.gz"},
+	} {
+		t.Run(tc.wantName, func(t *testing.T) {
+			dir := t.TempDir()
+			sink := &Sink{dir: dir, namer: fixedNamer("day"), format: tc.format, compress: tc.compress}
+
+			want := testExport("round trip")
+			if err := sink.write(context.Background(), "traces", want); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			// The Namer's path, with the extension for the format and compression.
+			p := filepath.Join(dir, "traces", "day", tc.wantName)
+			b, err := readCapture(p)
+			if err != nil {
+				t.Fatalf("failed to read the export back: %v", err)
+			}
+			unmarshal := proto.Unmarshal
+			if strings.HasSuffix(strings.TrimSuffix(p, ".gz"), ".json") {
+				unmarshal = protojson.Unmarshal
+			}
+			got := &collectortracepb.ExportTraceServiceRequest{}
+			if err := unmarshal(b, got); err != nil {
+				t.Fatalf("failed to parse %q: %v", p, err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("read back %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	collectormetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+var exportDuration syncfloat64.Histogram
+
+// initMetrics creates the sink's instruments. If interval is non-zero, they are written
+// to the sink's metrics stream every interval, alongside the metrics it receives;
+// otherwise they are discarded. The returned func writes the final values and stops.
+func initMetrics(sink *Sink, interval time.Duration) (func(context.Context) error, error) {
+	shutdown := func(context.Context) error { return nil }
+
+	if interval != 0 {
+		res := resource.NewSchemaless(attribute.String("service.name", "otelsink"))
+		meterProvider := metric.NewMeterProvider(
+			metric.WithResource(res),
+			metric.WithReader(metric.NewPeriodicReader(&selfMetricsExporter{sink: sink}, metric.WithInterval(interval))),
+		)
+		global.SetMeterProvider(meterProvider)
+		shutdown = meterProvider.Shutdown
+	}
+
+	meter := global.Meter("justinsb.com/otelsink")
+
+	var err error
+	exportDuration, err = meter.SyncFloat64().Histogram("export-duration", instrument.WithDescription("time spent writing an export to disk"), instrument.WithUnit("s"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating metric: %w", err)
+	}
+	return shutdown, nil
+}
+
+// selfMetricsExporter writes the sink's own metrics to its metrics stream.
+// It writes directly, rather than through Sink.Export (or over OTLP to ourselves),
+// so that writing our metrics doesn't itself add to export-duration.
+type selfMetricsExporter struct {
+	sink *Sink
+}
+
+var _ metric.Exporter = &selfMetricsExporter{}
+
+// Export implements metric.Exporter.
+func (e *selfMetricsExporter) Export(ctx context.Context, rm metricdata.ResourceMetrics) error {
+	return e.sink.write(ctx, "metrics", exportMetricsRequest(rm))
+}
+
+// ForceFlush implements metric.Exporter; nothing is buffered.
+func (e *selfMetricsExporter) ForceFlush(ctx context.Context) error {
+	return nil
+}
+
+// Shutdown implements metric.Exporter; the sink is closed by its owner.
+func (e *selfMetricsExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// exportMetricsRequest converts rm to the OTLP request a client would have sent us.
+// Only the aggregations we use are converted (histograms, sums and gauges).
+func exportMetricsRequest(rm metricdata.ResourceMetrics) *collectormetricspb.ExportMetricsServiceRequest {
+	resourceMetrics := &metricspb.ResourceMetrics{}
+	if rm.Resource != nil {
+		resourceMetrics.Resource = &resourcepb.Resource{Attributes: keyValues(rm.Resource.Attributes())}
+		resourceMetrics.SchemaUrl = rm.Resource.SchemaURL()
+	}
+	for _, sm := range rm.ScopeMetrics {
+		scopeMetrics := &metricspb.ScopeMetrics{
+			Scope:     &commonpb.InstrumentationScope{Name: sm.Scope.Name, Version: sm.Scope.Version},
+			SchemaUrl: sm.Scope.SchemaURL,
+		}
+		for _, m := range sm.Metrics {
+			out := &metricspb.Metric{Name: m.Name, Description: m.Description, Unit: string(m.Unit)}
+			switch data := m.Data.(type) {
+			case metricdata.Histogram:
+				out.Data = &metricspb.Metric_Histogram{Histogram: histogram(data)}
+			case metricdata.Sum[int64]:
+				out.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{DataPoints: numberDataPoints(data.DataPoints), AggregationTemporality: temporality(data.Temporality), IsMonotonic: data.IsMonotonic}}
+			case metricdata.Sum[float64]:
+				out.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{DataPoints: numberDataPoints(data.DataPoints), AggregationTemporality: temporality(data.Temporality), IsMonotonic: data.IsMonotonic}}
+			case metricdata.Gauge[int64]:
+				out.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: numberDataPoints(data.DataPoints)}}
+			case metricdata.Gauge[float64]:
+				out.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: numberDataPoints(data.DataPoints)}}
+			default:
+				continue
+			}
+			scopeMetrics.Metrics = append(scopeMetrics.Metrics, out)
+		}
+		resourceMetrics.ScopeMetrics = append(resourceMetrics.ScopeMetrics, scopeMetrics)
+	}
+	return &collectormetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{resourceMetrics}}
+}
+
+func histogram(h metricdata.Histogram) *metricspb.Histogram {
+	out := &metricspb.Histogram{AggregationTemporality: temporality(h.Temporality)}
+	for _, dp := range h.DataPoints {
+		sum := dp.Sum
+		out.DataPoints = append(out.DataPoints, &metricspb.HistogramDataPoint{
+			Attributes:        keyValues(dp.Attributes.ToSlice()),
+			StartTimeUnixNano: uint64(dp.StartTime.UnixNano()),
+			TimeUnixNano:      uint64(dp.Time.UnixNano()),
+			Count:             dp.Count,
+			Sum:               &sum,
+			BucketCounts:      dp.BucketCounts,
+			ExplicitBounds:    dp.Bounds,
+			Min:               dp.Min,
+			Max:               dp.Max,
+		})
+	}
+	return out
+}
+
+func numberDataPoints[N int64 | float64](dps []metricdata.DataPoint[N]) []*metricspb.NumberDataPoint {
+	var out []*metricspb.NumberDataPoint
+	for _, dp := range dps {
+		point := &metricspb.NumberDataPoint{
+			Attributes:        keyValues(dp.Attributes.ToSlice()),
+			StartTimeUnixNano: uint64(dp.StartTime.UnixNano()),
+			TimeUnixNano:      uint64(dp.Time.UnixNano()),
+		}
+		switch v := any(dp.Value).(type) {
+		case int64:
+			point.Value = &metricspb.NumberDataPoint_AsInt{AsInt: v}
+		case float64:
+			point.Value = &metricspb.NumberDataPoint_AsDouble{AsDouble: v}
+		}
+		out = append(out, point)
+	}
+	return out
+}
+
+func temporality(t metricdata.Temporality) metricspb.AggregationTemporality {
+	switch t {
+	case metricdata.CumulativeTemporality:
+		return metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	case metricdata.DeltaTemporality:
+		return metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	}
+	return metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED
+}
+
+// keyValues converts OpenTelemetry attributes to their OTLP protocol form.
+func keyValues(attrs []attribute.KeyValue) []*commonpb.KeyValue {
+	kvs := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		value := &commonpb.AnyValue{}
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			value.Value = &commonpb.AnyValue_BoolValue{BoolValue: kv.Value.AsBool()}
+		case attribute.INT64:
+			value.Value = &commonpb.AnyValue_IntValue{IntValue: kv.Value.AsInt64()}
+		case attribute.FLOAT64:
+			value.Value = &commonpb.AnyValue_DoubleValue{DoubleValue: kv.Value.AsFloat64()}
+		default:
+			value.Value = &commonpb.AnyValue_StringValue{StringValue: kv.Value.Emit()}
+		}
+		kvs = append(kvs, &commonpb.KeyValue{Key: string(kv.Key), Value: value})
+	}
+	return kvs
+}
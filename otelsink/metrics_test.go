@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	collectormetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSelfMetricsExporter(t *testing.T) {
+	dir := t.TempDir()
+	sink := &Sink{dir: dir, namer: fixedNamer("day"), format: formatProto}
+
+	reader := metric.NewManualReader()
+	histogram, err := metric.NewMeterProvider(metric.WithReader(reader)).Meter("test").SyncFloat64().Histogram("export-duration")
+	if err != nil {
+		t.Fatalf("failed to create histogram: %v", err)
+	}
+	histogram.Record(context.Background(), 0.5, attribute.String("stream", "traces"))
+	histogram.Record(context.Background(), 1.5, attribute.String("stream", "traces"))
+
+	rm, err := reader.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("failed to collect metrics: %v", err)
+	}
+	if err := (&selfMetricsExporter{sink: sink}).Export(context.Background(), rm); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "metrics", "day", "export.pb"))
+	if err != nil {
+		t.Fatalf("failed to read the metrics written: %v", err)
+	}
+	req := &collectormetricspb.ExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(b, req); err != nil {
+		t.Fatalf("failed to parse the metrics written: %v", err)
+	}
+	m := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0]
+	if m.GetName() != "export-duration" {
+		t.Fatalf("wrote metric %q, want export-duration", m.GetName())
+	}
+	dp := m.GetHistogram().GetDataPoints()[0]
+	if dp.GetCount() != 2 || dp.GetSum() != 2 {
+		t.Errorf("histogram has count %d and sum %v, want 2 and 2", dp.GetCount(), dp.GetSum())
+	}
+	if got := dp.GetAttributes()[0]; got.GetKey() != "stream" || got.GetValue().GetStringValue() != "traces" {
+		t.Errorf("histogram has attribute %v, want stream=traces", got)
+	}
+}
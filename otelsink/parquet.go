@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/parquet-go/parquet-go"
+	collectormetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// The parquet format flattens each export into one row per metric data point (metrics stream)
+// or per span (traces stream), for loading into analytics tools.
+// Attributes are stored as a JSON object in a string column, since their keys vary.
+// The logs stream is still written as proto.
+
+// metricPointRow is the parquet schema for the metrics stream.
+type metricPointRow struct {
+	ServiceName string `parquet:"service_name"`
+	ScopeName   string `parquet:"scope_name"`
+	MetricName  string `parquet:"metric_name"`
+	MetricUnit  string `parquet:"metric_unit"`
+	// MetricType is gauge, sum, histogram, exponential_histogram or summary.
+	MetricType        string `parquet:"metric_type"`
+	StartTimeUnixNano uint64 `parquet:"start_time_unix_nano"`
+	TimeUnixNano      uint64 `parquet:"time_unix_nano"`
+	Attributes        string `parquet:"attributes"`
+
+	// Value is set for gauge and sum points; integer values are converted to double.
+	Value *float64 `parquet:"value,optional"`
+
+	// Count and Sum are set for histogram and summary points.
+	Count *uint64  `parquet:"count,optional"`
+	Sum   *float64 `parquet:"sum,optional"`
+	// ExplicitBounds and BucketCounts are set for (explicit bucket) histogram points.
+	ExplicitBounds []float64 `parquet:"explicit_bounds"`
+	BucketCounts   []uint64  `parquet:"bucket_counts"`
+}
+
+// spanRow is the parquet schema for the traces stream.
+type spanRow struct {
+	ServiceName  string `parquet:"service_name"`
+	ScopeName    string `parquet:"scope_name"`
+	TraceID      string `parquet:"trace_id"`
+	SpanID       string `parquet:"span_id"`
+	ParentSpanID string `parquet:"parent_span_id"`
+	Name         string `parquet:"name"`
+	Kind         string `parquet:"kind"`
+
+	StartTimeUnixNano uint64 `parquet:"start_time_unix_nano"`
+	EndTimeUnixNano   uint64 `parquet:"end_time_unix_nano"`
+	DurationNanos     int64  `parquet:"duration_nanos"`
+
+	StatusCode    string `parquet:"status_code"`
+	StatusMessage string `parquet:"status_message"`
+	Attributes    string `parquet:"attributes"`
+	EventCount    int64  `parquet:"event_count"`
+}
+
+// writeParquet writes msg to p as parquet, returning false if the message type can't be flattened.
+func writeParquet(p string, msg proto.Message, compress string) (bool, error) {
+	var opts []parquet.WriterOption
+	if compress == "gzip" {
+		opts = append(opts, parquet.Compression(&parquet.Gzip))
+	}
+
+	var err error
+	switch msg := msg.(type) {
+	case *collectormetricspb.ExportMetricsServiceRequest:
+		err = parquet.WriteFile(p, flattenMetrics(msg), opts...)
+	case *collectortracepb.ExportTraceServiceRequest:
+		err = parquet.WriteFile(p, flattenSpans(msg), opts...)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to write parquet file %q: %w", p, err)
+	}
+	return true, nil
+}
+
+func flattenMetrics(req *collectormetricspb.ExportMetricsServiceRequest) []metricPointRow {
+	var rows []metricPointRow
+	for _, rm := range req.GetResourceMetrics() {
+		serviceName := serviceNameOf(rm.GetResource())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				base := metricPointRow{
+					ServiceName: serviceName,
+					ScopeName:   sm.GetScope().GetName(),
+					MetricName:  m.GetName(),
+					MetricUnit:  m.GetUnit(),
+				}
+
+				switch data := m.GetData().(type) {
+				case *metricspb.Metric_Gauge:
+					base.MetricType = "gauge"
+					rows = appendNumberPoints(rows, base, data.Gauge.GetDataPoints())
+				case *metricspb.Metric_Sum:
+					base.MetricType = "sum"
+					rows = appendNumberPoints(rows, base, data.Sum.GetDataPoints())
+				case *metricspb.Metric_Histogram:
+					base.MetricType = "histogram"
+					for _, dp := range data.Histogram.GetDataPoints() {
+						row := base
+						row.StartTimeUnixNano = dp.GetStartTimeUnixNano()
+						row.TimeUnixNano = dp.GetTimeUnixNano()
+						row.Attributes = attributesJSON(dp.GetAttributes())
+						count := dp.GetCount()
+						row.Count = &count
+						row.Sum = dp.Sum
+						row.ExplicitBounds = dp.GetExplicitBounds()
+						row.BucketCounts = dp.GetBucketCounts()
+						rows = append(rows, row)
+					}
+				case *metricspb.Metric_ExponentialHistogram:
+					base.MetricType = "exponential_histogram"
+					for _, dp := range data.ExponentialHistogram.GetDataPoints() {
+						row := base
+						row.StartTimeUnixNano = dp.GetStartTimeUnixNano()
+						row.TimeUnixNano = dp.GetTimeUnixNano()
+						row.Attributes = attributesJSON(dp.GetAttributes())
+						count := dp.GetCount()
+						row.Count = &count
+						row.Sum = dp.Sum
+						rows = append(rows, row)
+					}
+				case *metricspb.Metric_Summary:
+					base.MetricType = "summary"
+					for _, dp := range data.Summary.GetDataPoints() {
+						row := base
+						row.StartTimeUnixNano = dp.GetStartTimeUnixNano()
+						row.TimeUnixNano = dp.GetTimeUnixNano()
+						row.Attributes = attributesJSON(dp.GetAttributes())
+						count := dp.GetCount()
+						sum := dp.GetSum()
+						row.Count = &count
+						row.Sum = &sum
+						rows = append(rows, row)
+					}
+				}
+			}
+		}
+	}
+	return rows
+}
+
+func appendNumberPoints(rows []metricPointRow, base metricPointRow, points []*metricspb.NumberDataPoint) []metricPointRow {
+	for _, dp := range points {
+		row := base
+		row.StartTimeUnixNano = dp.GetStartTimeUnixNano()
+		row.TimeUnixNano = dp.GetTimeUnixNano()
+		row.Attributes = attributesJSON(dp.GetAttributes())
+
+		var value float64
+		switch v := dp.GetValue().(type) {
+		case *metricspb.NumberDataPoint_AsDouble:
+			value = v.AsDouble
+		case *metricspb.NumberDataPoint_AsInt:
+			value = float64(v.AsInt)
+		}
+		row.Value = &value
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func flattenSpans(req *collectortracepb.ExportTraceServiceRequest) []spanRow {
+	var rows []spanRow
+	for _, rs := range req.GetResourceSpans() {
+		serviceName := serviceNameOf(rs.GetResource())
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				rows = append(rows, spanRow{
+					ServiceName:       serviceName,
+					ScopeName:         ss.GetScope().GetName(),
+					TraceID:           hex.EncodeToString(span.GetTraceId()),
+					SpanID:            hex.EncodeToString(span.GetSpanId()),
+					ParentSpanID:      hex.EncodeToString(span.GetParentSpanId()),
+					Name:              span.GetName(),
+					Kind:              span.GetKind().String(),
+					StartTimeUnixNano: span.GetStartTimeUnixNano(),
+					EndTimeUnixNano:   span.GetEndTimeUnixNano(),
+					DurationNanos:     int64(span.GetEndTimeUnixNano() - span.GetStartTimeUnixNano()),
+					StatusCode:        span.GetStatus().GetCode().String(),
+					StatusMessage:     span.GetStatus().GetMessage(),
+					Attributes:        attributesJSON(span.GetAttributes()),
+					EventCount:        int64(len(span.GetEvents())),
+				})
+			}
+		}
+	}
+	return rows
+}
+
+// serviceNameOf returns the service.name resource attribute, or empty if not set.
+func serviceNameOf(resource *resourcepb.Resource) string {
+	for _, kv := range resource.GetAttributes() {
+		if kv.GetKey() == "service.name" {
+			return kv.GetValue().GetStringValue()
+		}
+	}
+	return ""
+}
+
+// attributesJSON encodes attributes as a JSON object.
+func attributesJSON(kvs []*commonpb.KeyValue) string {
+	if len(kvs) == 0 {
+		return "{}"
+	}
+	b, err := json.Marshal(attributesMap(kvs))
+	if err != nil {
+		// Only possible with values json can't represent (e.g. NaN).
+		return "{}"
+	}
+	return string(b)
+}
+
+func attributesMap(kvs []*commonpb.KeyValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		m[kv.GetKey()] = anyValue(kv.GetValue())
+	}
+	return m
+}
+
+func anyValue(v *commonpb.AnyValue) interface{} {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return v.BytesValue
+	case *commonpb.AnyValue_ArrayValue:
+		var values []interface{}
+		for _, e := range v.ArrayValue.GetValues() {
+			values = append(values, anyValue(e))
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		return attributesMap(v.KvlistValue.GetValues())
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// Segments are rolling files per stream and day (traces/2024/01/31/000001.log, ...) to which proto exports are
+// appended, rather than writing a file per export. The directory is that of the name from the sink's Namer,
+// so the day partitioning comes from timestampNamer. Each export is a varint length-delimited
+// message (see protodelim), so exports remain individually decodable. With gzip, each
+// export is its own gzip member; gzip readers decode the concatenation as one stream.
+
+// defaultSegmentSize is the size beyond which a segment is rotated, unless --segment-size is set.
+const defaultSegmentSize = 64 << 20
+
+// segmentExt is the extension of segment files, before any compression extension.
+const segmentExt = ".log"
+
+// segment is the open segment file of a stream.
+type segment struct {
+	f *os.File
+	// dir is the directory of the segment, from the Namer when it was opened.
+	dir string
+	// n is the number of the segment, used in its file name.
+	n int
+	// size is the number of bytes written to the segment so far.
+	size int64
+}
+
+// appendSegment appends msg to the current segment of the stream, rotating it first if it would grow past s.segmentSize.
+func (s *Sink) appendSegment(stream string, msg proto.Message) error {
+	var frame bytes.Buffer
+	if s.compress == "gzip" {
+		gz := gzip.NewWriter(&frame)
+		if _, err := protodelim.MarshalTo(gz, msg); err != nil {
+			return fmt.Errorf("failed to serialize message: %w", err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to compress message: %w", err)
+		}
+	} else {
+		if _, err := protodelim.MarshalTo(&frame, msg); err != nil {
+			return fmt.Errorf("failed to serialize message: %w", err)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dir := filepath.Join(s.dir, filepath.Dir(s.name(stream, msg)))
+
+	seg := s.segments[stream]
+	if seg != nil && seg.dir != dir {
+		// A new directory (e.g. a new day) restarts the numbering from 1.
+		if err := seg.f.Close(); err != nil {
+			return fmt.Errorf("failed to close segment %q: %w", seg.f.Name(), err)
+		}
+		delete(s.segments, stream)
+		seg = nil
+	}
+	if seg != nil && seg.size != 0 && seg.size+int64(frame.Len()) > s.segmentSize {
+		if err := seg.f.Close(); err != nil {
+			return fmt.Errorf("failed to close segment %q: %w", seg.f.Name(), err)
+		}
+		delete(s.segments, stream)
+		next, err := s.openSegment(stream, dir, seg.n+1)
+		if err != nil {
+			return err
+		}
+		seg = next
+	}
+	if seg == nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %q: %w", dir, err)
+		}
+		// Never append to an existing segment, which may end with a partial write.
+		last, err := lastSegment(dir)
+		if err != nil {
+			return err
+		}
+		seg, err = s.openSegment(stream, dir, last+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	written, err := seg.f.Write(frame.Bytes())
+	seg.size += int64(written)
+	if err != nil {
+		// The segment may now end with a partial frame, which would make the exports appended
+		// after it unreadable, so the next export starts a new segment.
+		seg.f.Close()
+		delete(s.segments, stream)
+		return fmt.Errorf("failed to write segment %q: %w", seg.f.Name(), err)
+	}
+	return nil
+}
+
+// openSegment creates segment number n of the stream in dir, and makes it the stream's current segment.
+// The caller must hold s.mutex.
+func (s *Sink) openSegment(stream string, dir string, n int) (*segment, error) {
+	name := fmt.Sprintf("%06d", n) + segmentExt
+	if s.compress == "gzip" {
+		name += ".gz"
+	}
+	p := filepath.Join(dir, name)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment %q: %w", p, err)
+	}
+
+	seg := &segment{f: f, dir: dir, n: n}
+	if s.segments == nil {
+		s.segments = make(map[string]*segment)
+	}
+	s.segments[stream] = seg
+	return seg, nil
+}
+
+// lastSegment returns the highest segment number in dir, or 0 if there are none.
+func lastSegment(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list directory %q: %w", dir, err)
+	}
+	last := 0
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(strings.TrimSuffix(entry.Name(), ".gz"), segmentExt)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(name); err == nil && n > last {
+			last = n
+		}
+	}
+	return last, nil
+}
+
+// isSegment reports whether p is a segment file, rather than a single export.
+func isSegment(p string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(p, ".gz"), segmentExt)
+}
+
+// Close closes the open segment files.
+func (s *Sink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var errs []error
+	for stream, seg := range s.segments {
+		if err := seg.f.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close segment %q: %w", seg.f.Name(), err))
+		}
+		delete(s.segments, stream)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// testExport is a small trace export.
+func testExport(name string) *collectortracepb.ExportTraceServiceRequest {
+	return &collectortracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Spans: []*tracepb.Span{{Name: name}},
+			}},
+		}},
+	}
+}
+
+// fixedNamer names every export stream/dir/export, so tests know where files go.
+func fixedNamer(dir string) Namer {
+	return func(stream string, msg proto.Message) string {
+		return filepath.Join(stream, dir, "export")
+	}
+}
+
+// readSegment decodes the exports in the segment file p.
+func readSegment(t *testing.T, p string) []string {
+	t.Helper()
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	defer f.Close()
+
+	var names []string
+	r := bufio.NewReader(f)
+	for {
+		msg := &collectortracepb.ExportTraceServiceRequest{}
+		if err := protodelim.UnmarshalFrom(r, msg); err != nil {
+			break
+		}
+		names = append(names, msg.GetResourceSpans()[0].GetScopeSpans()[0].GetSpans()[0].GetName())
+	}
+	return names
+}
+
+func TestAppendSegmentAfterWriteError(t *testing.T) {
+	dir := t.TempDir()
+	sink := &Sink{dir: dir, namer: fixedNamer("day"), format: formatProto, segmentSize: defaultSegmentSize}
+	defer sink.Close()
+
+	if err := sink.appendSegment("traces", testExport("first")); err != nil {
+		t.Fatalf("appendSegment failed: %v", err)
+	}
+
+	// Make the next write fail.
+	sink.segments["traces"].f.Close()
+	if err := sink.appendSegment("traces", testExport("lost")); err == nil {
+		t.Fatalf("appendSegment succeeded writing to a closed segment")
+	}
+
+	if err := sink.appendSegment("traces", testExport("second")); err != nil {
+		t.Fatalf("appendSegment failed after a write error: %v", err)
+	}
+	sink.Close()
+
+	segments := filepath.Join(dir, "traces", "day")
+	if got := readSegment(t, filepath.Join(segments, "000001"+segmentExt)); len(got) != 1 || got[0] != "first" {
+		t.Errorf("first segment has exports %v, want [first]", got)
+	}
+	if got := readSegment(t, filepath.Join(segments, "000002"+segmentExt)); len(got) != 1 || got[0] != "second" {
+		t.Errorf("second segment has exports %v, want [second]", got)
+	}
+}